@@ -0,0 +1,77 @@
+package main
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Counts limiter rejections per second
+type RejectionRate struct {
+	mu      sync.Mutex
+	second  int64
+	current int
+	last    int
+}
+
+func (r *RejectionRate) Add() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.advance()
+	r.current++
+}
+
+// Rejections in the last full second, or in the current one if it has more
+func (r *RejectionRate) PerSecond() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.advance()
+	if r.current > r.last {
+		return r.current
+	}
+
+	return r.last
+}
+
+func (r *RejectionRate) advance() {
+	now := time.Now().Unix()
+	switch {
+	case now == r.second:
+	case now == r.second+1:
+		r.last, r.current = r.current, 0
+	default:
+		r.last, r.current = 0, 0
+	}
+	r.second = now
+}
+
+// Backoff hint for rejected clients, grows with the rate of rejections so
+// that retry storms spread out instead of hammering a saturated server
+func (h *Handler) retryAfter() time.Duration {
+	hint := h.config.RetryAfterBase + time.Duration(h.rejections.PerSecond())*h.config.RetryAfterScale
+	if hint > h.config.RetryAfterMax {
+		return h.config.RetryAfterMax
+	}
+
+	return hint
+}
+
+func (h *Handler) rejectLimitReached(w http.ResponseWriter) error {
+	return h.rejectWithRetryAfter(w, "Max parallel requests reached")
+}
+
+func (h *Handler) rejectWithRetryAfter(w http.ResponseWriter, reason string) error {
+	h.rejections.Add()
+
+	seconds := int(math.Ceil(h.retryAfter().Seconds()))
+	if seconds < 1 {
+		seconds = 1
+	}
+
+	w.Header().Set("Retry-After", strconv.Itoa(seconds))
+	return errorResponse(w, 503, ErrorLimitReached, reason)
+}
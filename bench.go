@@ -0,0 +1,131 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"sort"
+	"time"
+)
+
+// Max fetches of a single benchmark run
+const MaxBenchCount = 1000
+
+type benchRequest struct {
+	Url UrlEntry `json:"url"`
+	// How many times url is fetched
+	Count     int   `json:"count"`
+	TimeoutMs int64 `json:"timeout_ms"`
+}
+
+func readBenchRequest(r io.Reader) (*benchRequest, error) {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+
+	var request benchRequest
+	if err := json.Unmarshal(data, &request); err != nil {
+		return nil, err
+	}
+
+	if request.Url.Url == "" {
+		return nil, fmt.Errorf("url is required")
+	}
+
+	if request.Count < 1 || request.Count > MaxBenchCount {
+		return nil, fmt.Errorf("count must be between 1 and %d", MaxBenchCount)
+	}
+
+	if request.TimeoutMs < 0 {
+		return nil, fmt.Errorf("timeout_ms must not be negative")
+	}
+
+	return &request, nil
+}
+
+// Nearest-rank percentile of sorted durations
+func percentile(sorted []int64, p int) int64 {
+	if len(sorted) == 0 {
+		return 0
+	}
+
+	rank := (p*len(sorted) + 99) / 100
+	if rank < 1 {
+		rank = 1
+	}
+
+	return sorted[rank-1]
+}
+
+// Fetches a url count times through the usual download pipeline and reports
+// throughput of the service itself
+func (h *Handler) onBench(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != "POST" {
+		return errorResponse(w, 400, ErrorMethodNotAllowed, "Method not supported")
+	}
+
+	if err := h.limiter.Acquire(); err != nil {
+		return h.rejectLimitReached(w)
+	}
+	// Held for the whole benchmark, says nothing about latency
+	defer h.limiter.Release(0)
+
+	request, err := readBenchRequest(r.Body)
+	if err != nil {
+		return errorResponse(w, 400, ErrorInvalidRequest, err.Error())
+	}
+
+	opts := h.newDownloadOptions(&Request{TimeoutMs: request.TimeoutMs})
+	// Cached responses would measure the cache, not the pipeline
+	opts.Cache = nil
+
+	ctx := r.Context()
+	retryBudget := int32(opts.RetryBudget)
+	tasks := make(chan UrlEntry, request.Count)
+	for i := 0; i < request.Count; i++ {
+		tasks <- request.Url
+	}
+	close(tasks)
+
+	results := make(chan TaskResult, request.Count)
+	started := time.Now()
+	for i := 0; i < workerCount(request.Count); i++ {
+		go func() {
+			for entry := range tasks {
+				results <- downloadWithRetries(ctx, h.client, entry, opts, &retryBudget)
+			}
+		}()
+	}
+
+	durations := make([]int64, 0, request.Count)
+	var failed int
+	var totalBytes int64
+	for i := 0; i < request.Count; i++ {
+		result := <-results
+		durations = append(durations, result.DurationMs)
+		totalBytes += int64(len(result.Result))
+		if result.Err != nil {
+			failed++
+		}
+	}
+	elapsed := time.Since(started)
+	sort.Slice(durations, func(i, j int) bool { return durations[i] < durations[j] })
+
+	log.Printf("Benchmark of \"%s\": %d fetches, %d failed in %s", request.Url.Url, request.Count, failed, elapsed)
+	return jsonResponse(w, 200, map[string]interface{}{
+		"success":          true,
+		"count":            request.Count,
+		"failed":           failed,
+		"error_rate":       float64(failed) / float64(request.Count),
+		"elapsed_ms":       elapsed.Milliseconds(),
+		"requests_per_sec": float64(request.Count) / elapsed.Seconds(),
+		"total_bytes":      totalBytes,
+		"p50_ms":           percentile(durations, 50),
+		"p90_ms":           percentile(durations, 90),
+		"p99_ms":           percentile(durations, 99),
+	})
+}
@@ -0,0 +1,291 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const MaxCacheEntries = 1000
+
+// Outgoing headers left out of the cache key: per-hop ones and tracing ids
+// unique to each request, which would make every key different. Any other
+// header may change the downstream response, so a response fetched with one
+// set of headers is never served for a request with another.
+var cacheKeyIgnoredHeaders = map[string]bool{
+	"Connection":        true,
+	"Keep-Alive":        true,
+	"Te":                true,
+	"Trailer":           true,
+	"Transfer-Encoding": true,
+	"Upgrade":           true,
+	"Traceparent":       true,
+	"Tracestate":        true,
+	"X-Request-Id":      true,
+}
+
+// Client asked for fresh bodies with Cache-Control: no-cache
+func noCacheRequested(r *http.Request) bool {
+	for _, directive := range strings.Split(r.Header.Get("Cache-Control"), ",") {
+		if strings.EqualFold(strings.TrimSpace(directive), "no-cache") {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Bodies kept compressed with preserve_encoding differ from decoded ones of
+// the same request, so they are cached apart. So are responses fetched with
+// other redirect policy: a redirect returned as is must not be served to a
+// request that would follow it.
+func cacheKey(r *http.Request, preserveEncoding bool, redirects *redirectPolicy) string {
+	hash := sha256.New()
+	write := func(s string) {
+		hash.Write([]byte(s))
+		hash.Write([]byte{0})
+	}
+
+	write(r.Method)
+	write(r.URL.String())
+	write(strconv.FormatBool(preserveEncoding))
+	write(strconv.FormatBool(redirects.follow))
+	if redirects.follow {
+		write(strconv.Itoa(redirects.max))
+	}
+	names := make([]string, 0, len(r.Header))
+	for name := range r.Header {
+		if name = http.CanonicalHeaderKey(name); !cacheKeyIgnoredHeaders[name] {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		write(name)
+		for _, value := range r.Header.Values(name) {
+			write(value)
+		}
+	}
+
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+type cacheEntry struct {
+	// Result without body, the body is kept in body
+	result TaskResult
+	body   []byte
+	// body is gzip compressed, size is its uncompressed length
+	compressed bool
+	size       int
+	// Limit the body was read with
+	maxBytes int64
+	expires  time.Time
+}
+
+// In-memory cache of successfully downloaded results
+type ResponseCache struct {
+	ttl time.Duration
+	// Bodies of at least this size are stored gzip compressed (0 - never)
+	compressMinBytes int
+
+	mu      sync.Mutex
+	entries map[string]cacheEntry
+	// Size of cached bodies before and after compression
+	bodyBytes   int64
+	storedBytes int64
+	// Misses being fetched right now
+	flights flightGroup
+}
+
+func newResponseCache(ttl time.Duration, compressMinBytes int) *ResponseCache {
+	return &ResponseCache{
+		ttl:              ttl,
+		compressMinBytes: compressMinBytes,
+		entries:          make(map[string]cacheEntry),
+	}
+}
+
+// Compressing text bodies roughly halves memory of the cache or better, at
+// the price of gzip on every miss and gunzip on every hit. Incompressible
+// bodies are stored as is.
+func (c *ResponseCache) compress(body string) ([]byte, bool) {
+	if c.compressMinBytes <= 0 || len(body) < c.compressMinBytes {
+		return []byte(body), false
+	}
+
+	var buf bytes.Buffer
+	zw, _ := gzip.NewWriterLevel(&buf, gzip.BestSpeed)
+	if _, err := zw.Write([]byte(body)); err != nil {
+		return []byte(body), false
+	}
+	if err := zw.Close(); err != nil {
+		return []byte(body), false
+	}
+
+	if buf.Len() >= len(body) {
+		return []byte(body), false
+	}
+
+	return buf.Bytes(), true
+}
+
+func (e *cacheEntry) uncompressed() (string, error) {
+	if !e.compressed {
+		return string(e.body), nil
+	}
+
+	zr, err := gzip.NewReader(bytes.NewReader(e.body))
+	if err != nil {
+		return "", err
+	}
+
+	data, err := ioutil.ReadAll(zr)
+	if err != nil {
+		return "", err
+	}
+
+	return string(data), nil
+}
+
+// Removes entry keeping the size counters in sync, mu must be held
+func (c *ResponseCache) remove(key string) {
+	if entry, ok := c.entries[key]; ok {
+		c.bodyBytes -= int64(entry.size)
+		c.storedBytes -= int64(len(entry.body))
+		delete(c.entries, key)
+	}
+}
+
+func (c *ResponseCache) Stats() map[string]interface{} {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return map[string]interface{}{
+		"entries":      len(c.entries),
+		"body_bytes":   c.bodyBytes,
+		"stored_bytes": c.storedBytes,
+	}
+}
+
+// Returns result with body cut to maxBytes. An entry truncated to a smaller
+// limit than requested can't satisfy the request and is reported as a miss.
+func (c *ResponseCache) Get(key string, maxBytes int64) (TaskResult, bool) {
+	c.mu.Lock()
+	entry, ok := c.entries[key]
+	if ok && time.Now().After(entry.expires) {
+		c.remove(key)
+		ok = false
+	}
+	c.mu.Unlock()
+
+	if !ok || entry.result.Truncated && entry.maxBytes < maxBytes {
+		return TaskResult{}, false
+	}
+
+	// Decompressed outside of the lock, entry body is never modified
+	body, err := entry.uncompressed()
+	if err != nil {
+		log.Printf("Failed to decompress cached body: %s", err)
+		return TaskResult{}, false
+	}
+
+	result := entry.result
+	result.Result = body
+	if int64(len(result.Result)) > maxBytes {
+		result.Result = result.Result[:maxBytes]
+		result.Truncated = true
+	}
+
+	return result, true
+}
+
+func (c *ResponseCache) Put(key string, result TaskResult, maxBytes int64) {
+	body, compressed := c.compress(result.Result)
+	entry := cacheEntry{
+		result:     result,
+		body:       body,
+		compressed: compressed,
+		size:       len(result.Result),
+		maxBytes:   maxBytes,
+		expires:    time.Now().Add(c.ttl),
+	}
+	entry.result.Result = ""
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.remove(key)
+	if len(c.entries) >= MaxCacheEntries {
+		c.removeExpired()
+	}
+
+	if len(c.entries) >= MaxCacheEntries {
+		return
+	}
+
+	c.entries[key] = entry
+	c.bodyBytes += int64(entry.size)
+	c.storedBytes += int64(len(body))
+}
+
+// Returns cached result or calls fetch and caches its result. Concurrent misses
+// of the same key wait for a single fetch instead of hitting downstream again.
+// Requests join a fetch only with the same variant, see flightVariant
+func (c *ResponseCache) GetOrFetch(ctx context.Context, key string, maxBytes int64, variant string, fetch func() (*TaskResult, error)) (*TaskResult, error) {
+	if result, ok := c.Get(key, maxBytes); ok {
+		return &result, nil
+	}
+
+	// Shared result is read with the leader's body limit
+	flightKey := fmt.Sprintf("%s:%d:%s", key, maxBytes, variant)
+	val, shared, err := c.flights.Do(flightKey, func() (interface{}, error) {
+		if result, ok := c.Get(key, maxBytes); ok {
+			return result, nil
+		}
+
+		result, err := fetch()
+		if err != nil {
+			return nil, err
+		}
+
+		// Partial body depends on how fast it was downloaded this time
+		if !result.PartialBody {
+			c.Put(key, *result, maxBytes)
+		}
+		return *result, nil
+	})
+
+	// Leader's client went away, that says nothing about our request
+	if shared && errors.Is(err, context.Canceled) && ctx.Err() == nil {
+		return fetch()
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	result := val.(TaskResult)
+	return &result, nil
+}
+
+func (c *ResponseCache) removeExpired() {
+	now := time.Now()
+	for key, entry := range c.entries {
+		if now.After(entry.expires) {
+			c.remove(key)
+		}
+	}
+}
@@ -0,0 +1,261 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestCacheKeyHeaders(t *testing.T) {
+	tests := []struct {
+		name      string
+		a, b      http.Header
+		wantEqual bool
+	}{
+		{
+			name:      "same headers",
+			a:         http.Header{"User-Agent": {"a"}},
+			b:         http.Header{"User-Agent": {"a"}},
+			wantEqual: true,
+		},
+		{
+			name: "different user agent",
+			a:    http.Header{"User-Agent": {"a"}},
+			b:    http.Header{"User-Agent": {"b"}},
+		},
+		{
+			name: "referer only in one",
+			a:    http.Header{"Referer": {"http://a/"}},
+			b:    http.Header{},
+		},
+		{
+			name: "different authorization",
+			a:    http.Header{"Authorization": {"Bearer a"}},
+			b:    http.Header{"Authorization": {"Bearer b"}},
+		},
+		{
+			name: "value moved to another header",
+			a:    http.Header{"Accept": {"x"}},
+			b:    http.Header{"Accept-Language": {"x"}},
+		},
+		{
+			name: "different forwarded header",
+			a:    http.Header{"X-Api-Version": {"1"}},
+			b:    http.Header{"X-Api-Version": {"2"}},
+		},
+		{
+			name: "forwarded header only in one",
+			a:    http.Header{"X-Tenant": {"a"}},
+			b:    http.Header{},
+		},
+		{
+			name:      "tracing header",
+			a:         http.Header{"Traceparent": {"00-1-1-01"}},
+			b:         http.Header{"Traceparent": {"00-2-2-01"}},
+			wantEqual: true,
+		},
+	}
+
+	redirects := &redirectPolicy{follow: true, max: DefaultRedirectsPerUrl}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			a := httptest.NewRequest("GET", "http://example.com/page", nil)
+			a.Header = test.a
+			b := httptest.NewRequest("GET", "http://example.com/page", nil)
+			b.Header = test.b
+
+			if equal := cacheKey(a, false, redirects) == cacheKey(b, false, redirects); equal != test.wantEqual {
+				t.Errorf("keys equal = %t, want %t", equal, test.wantEqual)
+			}
+		})
+	}
+}
+
+func TestCacheKeepsResponsesOfHeadersApart(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("agent " + r.Header.Get("User-Agent")))
+	}))
+	defer server.Close()
+
+	cache := newResponseCache(time.Minute, 0)
+	for _, agent := range []string{"a", "b", "a"} {
+		opts := testOptions()
+		opts.Cache = cache
+		opts.Headers = http.Header{"User-Agent": {agent}}
+
+		result, err := downloadUrl(context.Background(), server.Client(), server.URL, opts)
+		if err != nil {
+			t.Fatalf("downloadUrl: %v", err)
+		}
+		if want := "agent " + agent; result.Result != want {
+			t.Errorf("body with User-Agent %s = %q, want %q", agent, result.Result, want)
+		}
+	}
+}
+
+func TestCachedRedirectIsNotServedToFollowingRequest(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/moved" {
+			http.Redirect(w, r, "/target", http.StatusMovedPermanently)
+			return
+		}
+		w.Write([]byte("target"))
+	}))
+	defer server.Close()
+
+	client := server.Client()
+	client.CheckRedirect = checkRedirect
+	cache := newResponseCache(time.Minute, 0)
+
+	raw := testOptions()
+	raw.Cache = cache
+	raw.MaxRedirects = DefaultRedirectsPerUrl
+	raw.AcceptStatus = map[int]bool{http.StatusMovedPermanently: true}
+	result, err := downloadUrl(context.Background(), client, server.URL+"/moved", raw)
+	if err != nil {
+		t.Fatalf("downloadUrl accepting 301: %v", err)
+	}
+	if result.StatusCode != http.StatusMovedPermanently {
+		t.Fatalf("status accepting 301 = %d, want 301", result.StatusCode)
+	}
+
+	following := testOptions()
+	following.Cache = cache
+	following.MaxRedirects = DefaultRedirectsPerUrl
+	result, err = downloadUrl(context.Background(), client, server.URL+"/moved", following)
+	if err != nil {
+		t.Fatalf("downloadUrl following redirects: %v", err)
+	}
+	if result.StatusCode != http.StatusOK || result.Result != "target" {
+		t.Errorf("following redirects got status %d body %q, want 200 \"target\"", result.StatusCode, result.Result)
+	}
+}
+
+// Server answering after delay, counting requests it got
+func newSlowServer(t *testing.T, delay time.Duration) (*httptest.Server, *int32) {
+	t.Helper()
+
+	var hits int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&hits, 1)
+		time.Sleep(delay)
+		w.Write([]byte("body"))
+	}))
+	t.Cleanup(server.Close)
+
+	return server, &hits
+}
+
+// Fetches url with every options at once, fails on errors
+func fetchConcurrently(t *testing.T, url string, options []DownloadOptions) {
+	t.Helper()
+
+	var wg sync.WaitGroup
+	errs := make(chan error, len(options))
+	for _, opts := range options {
+		wg.Add(1)
+		go func(opts DownloadOptions) {
+			defer wg.Done()
+			if _, err := downloadUrl(context.Background(), http.DefaultClient, url, opts); err != nil {
+				errs <- err
+			}
+		}(opts)
+	}
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		t.Errorf("downloadUrl: %v", err)
+	}
+}
+
+func TestConcurrentMissesShareOneFetch(t *testing.T) {
+	server, hits := newSlowServer(t, 200*time.Millisecond)
+	cache := newResponseCache(time.Minute, 0)
+
+	options := make([]DownloadOptions, 10)
+	for i := range options {
+		options[i] = testOptions()
+		options[i].Cache = cache
+	}
+	fetchConcurrently(t, server.URL, options)
+
+	if got := atomic.LoadInt32(hits); got != 1 {
+		t.Errorf("downstream got %d requests, want 1", got)
+	}
+}
+
+func TestFetchesOfOtherOutcomeOptionsAreNotShared(t *testing.T) {
+	tests := []struct {
+		name   string
+		change func(opts *DownloadOptions)
+	}{
+		{name: "timeout", change: func(opts *DownloadOptions) { opts.Timeout = 4 * time.Second }},
+		{name: "accept_status", change: func(opts *DownloadOptions) { opts.AcceptStatus = map[int]bool{200: true, 404: true} }},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			server, hits := newSlowServer(t, 200*time.Millisecond)
+			cache := newResponseCache(time.Minute, 0)
+
+			leader, follower := testOptions(), testOptions()
+			leader.Cache, follower.Cache = cache, cache
+			test.change(&follower)
+			fetchConcurrently(t, server.URL, []DownloadOptions{leader, follower})
+
+			if got := atomic.LoadInt32(hits); got != 2 {
+				t.Errorf("downstream got %d requests, want 2", got)
+			}
+		})
+	}
+}
+
+func TestNoCacheRequested(t *testing.T) {
+	tests := []struct {
+		cacheControl string
+		want         bool
+	}{
+		{cacheControl: "", want: false},
+		{cacheControl: "no-cache", want: true},
+		{cacheControl: "No-Cache", want: true},
+		{cacheControl: "max-age=0, no-cache", want: true},
+		{cacheControl: "no-store", want: false},
+	}
+
+	for _, test := range tests {
+		r := httptest.NewRequest("POST", "/", nil)
+		if test.cacheControl != "" {
+			r.Header.Set("Cache-Control", test.cacheControl)
+		}
+
+		if got := noCacheRequested(r); got != test.want {
+			t.Errorf("noCacheRequested(Cache-Control: %q) = %t, want %t", test.cacheControl, got, test.want)
+		}
+	}
+}
+
+func TestNoCacheBypassesCache(t *testing.T) {
+	server, hits := newSlowServer(t, 0)
+	cache := newResponseCache(time.Minute, 0)
+
+	// Second fetch bypasses the entry of the first, third one is served by it
+	// as the bypassing one didn't replace it
+	for i, noCache := range []bool{false, true, false} {
+		opts := testOptions()
+		opts.Cache = cache
+		opts.NoCache = noCache
+		if _, err := downloadUrl(context.Background(), server.Client(), server.URL, opts); err != nil {
+			t.Fatalf("downloadUrl: %v", err)
+		}
+
+		want := []int32{1, 2, 2}[i]
+		if got := atomic.LoadInt32(hits); got != want {
+			t.Errorf("after fetch %d with no_cache %t downstream got %d requests, want %d", i+1, noCache, got, want)
+		}
+	}
+}
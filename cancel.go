@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+)
+
+const MaxCancelTokenLength = 256
+
+// Cause of requests canceled through /cancel
+var errCanceledByToken = errors.New("request canceled by cancel_token")
+
+// Cancel functions of in-flight requests by tenant and client chosen token.
+// Tokens are scoped to tenants, so nobody cancels others' requests by guessing.
+type CancelTokens struct {
+	mu     sync.Mutex
+	active map[string]context.CancelCauseFunc
+}
+
+func newCancelTokens() *CancelTokens {
+	return &CancelTokens{active: make(map[string]context.CancelCauseFunc)}
+}
+
+// Returns ctx canceled by Cancel with the same tenant and token. Release
+// must be called when the request completes.
+func (c *CancelTokens) Register(ctx context.Context, tenant, token string) (context.Context, func(), error) {
+	key := tenant + "\x00" + token
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.active[key]; ok {
+		return nil, nil, fmt.Errorf("cancel_token is already used by an in-flight request")
+	}
+
+	ctx, cancel := context.WithCancelCause(ctx)
+	c.active[key] = cancel
+	release := func() {
+		c.mu.Lock()
+		delete(c.active, key)
+		c.mu.Unlock()
+		cancel(nil)
+	}
+
+	return ctx, release, nil
+}
+
+// Reports whether a request with the token was in flight
+func (c *CancelTokens) Cancel(tenant, token string) bool {
+	c.mu.Lock()
+	cancel, ok := c.active[tenant+"\x00"+token]
+	c.mu.Unlock()
+
+	if ok {
+		cancel(errCanceledByToken)
+	}
+
+	return ok
+}
+
+// Whether ctx of a request was canceled through /cancel
+func canceledByToken(ctx context.Context) bool {
+	return errors.Is(context.Cause(ctx), errCanceledByToken)
+}
+
+func (h *Handler) onCancel(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != "POST" {
+		return errorResponse(w, 400, ErrorMethodNotAllowed, "Method not supported")
+	}
+
+	var request struct {
+		CancelToken string `json:"cancel_token"`
+	}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 4*MaxCancelTokenLength)).Decode(&request); err != nil {
+		return errorResponse(w, 400, ErrorInvalidRequest, err.Error())
+	}
+	if request.CancelToken == "" {
+		return errorResponse(w, 400, ErrorInvalidRequest, "cancel_token is required")
+	}
+
+	if !h.cancelTokens.Cancel(h.tenantOf(r), request.CancelToken) {
+		return errorResponse(w, 404, ErrorUnknownToken, "No in-flight request with this cancel_token")
+	}
+
+	return jsonResponse(w, 200, map[string]interface{}{
+		"success": true,
+	})
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"mime"
+	"strings"
+	"unicode/utf16"
+	"unicode/utf8"
+)
+
+// Characters of windows-1252 at 0x80-0x9F, where it differs from ISO-8859-1.
+// Unassigned bytes map to themselves like in browsers.
+var windows1252 = [32]rune{
+	'€', '\u0081', '‚', 'ƒ', '„', '…', '†', '‡',
+	'ˆ', '‰', 'Š', '‹', 'Œ', '\u008D', 'Ž', '\u008F',
+	'\u0090', '‘', '’', '“', '”', '•', '–', '—',
+	'˜', '™', 'š', '›', 'œ', '\u009D', 'ž', 'Ÿ',
+}
+
+// Lowercase charset from Content-Type, empty if not declared
+func declaredCharset(contentType string) string {
+	_, params, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return ""
+	}
+
+	return strings.ToLower(strings.TrimSpace(params["charset"]))
+}
+
+// Converts body in charset to UTF-8. Reports false for charsets it doesn't
+// know, the body is to be kept as is then.
+func transcodeToUTF8(body string, charset string) (string, bool) {
+	switch charset {
+	case "utf-8", "utf8", "us-ascii", "ascii":
+		return body, true
+	case "iso-8859-1", "latin1", "l1":
+		return decodeSingleByte(body, nil), true
+	case "windows-1252", "cp1252":
+		return decodeSingleByte(body, &windows1252), true
+	case "utf-16", "utf-16le", "utf-16be":
+		return decodeUTF16(body, charset), true
+	}
+
+	return body, false
+}
+
+// ISO-8859-1 bytes are the first 256 code points. high overrides 0x80-0x9F.
+func decodeSingleByte(body string, high *[32]rune) string {
+	var b strings.Builder
+	b.Grow(len(body))
+	for i := 0; i < len(body); i++ {
+		c := body[i]
+		if high != nil && c >= 0x80 && c <= 0x9F {
+			b.WriteRune(high[c-0x80])
+		} else {
+			b.WriteRune(rune(c))
+		}
+	}
+
+	return b.String()
+}
+
+// Plain "utf-16" is big endian unless a byte order mark says otherwise
+func decodeUTF16(body string, charset string) string {
+	bigEndian := charset != "utf-16le"
+	if charset == "utf-16" && len(body) >= 2 {
+		switch {
+		case body[0] == 0xFF && body[1] == 0xFE:
+			bigEndian = false
+			body = body[2:]
+		case body[0] == 0xFE && body[1] == 0xFF:
+			body = body[2:]
+		}
+	}
+
+	units := make([]uint16, 0, len(body)/2)
+	for i := 0; i+1 < len(body); i += 2 {
+		if bigEndian {
+			units = append(units, uint16(body[i])<<8|uint16(body[i+1]))
+		} else {
+			units = append(units, uint16(body[i+1])<<8|uint16(body[i]))
+		}
+	}
+
+	var b strings.Builder
+	b.Grow(len(units))
+	for _, r := range utf16.Decode(units) {
+		b.WriteRune(r)
+	}
+	if len(body)%2 != 0 {
+		b.WriteRune(utf8.RuneError)
+	}
+
+	return b.String()
+}
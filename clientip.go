@@ -0,0 +1,179 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Proxies whose X-Forwarded-For is believed
+type TrustedProxies []*net.IPNet
+
+// Parses comma separated IPs and CIDRs
+func parseTrustedProxies(value string) (TrustedProxies, error) {
+	var proxies TrustedProxies
+	for _, item := range strings.Split(value, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+
+		if !strings.Contains(item, "/") {
+			ip := net.ParseIP(item)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid proxy address \"%s\"", item)
+			}
+
+			bits := 8 * net.IPv4len
+			if ip.To4() == nil {
+				bits = 8 * net.IPv6len
+			}
+			proxies = append(proxies, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+
+		_, network, err := net.ParseCIDR(item)
+		if err != nil {
+			return nil, fmt.Errorf("invalid proxy network \"%s\"", item)
+		}
+		proxies = append(proxies, network)
+	}
+
+	return proxies, nil
+}
+
+func (t TrustedProxies) Contains(ip net.IP) bool {
+	for _, network := range t {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Client address of the request. X-Forwarded-For is walked from the right
+// while hops are trusted proxies, the first untrusted hop is the client.
+func (t TrustedProxies) ClientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+
+	ip := net.ParseIP(host)
+	if ip == nil || !t.Contains(ip) {
+		return host
+	}
+
+	hops := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := net.ParseIP(strings.TrimSpace(hops[i]))
+		if hop == nil {
+			// Garbage from an untrusted hop, last trusted one is all we know
+			break
+		}
+
+		host = hop.String()
+		if !t.Contains(hop) {
+			break
+		}
+	}
+
+	return host
+}
+
+type requestInfoKey struct{}
+
+// Details of a request for logs, filled while it is served
+type RequestInfo struct {
+	// From X-Request-Id or random, returned in X-Request-Id
+	ID       string
+	ClientIP string
+	Started  time.Time
+	// Request body bytes read so far
+	bodyBytes int64
+	// Concurrent fetches of the request, 0 until chosen
+	concurrency int32
+	// Set once all urls of a batch were attempted, see SetCompleted
+	completed int32
+}
+
+// Request ids given by clients in X-Request-Id, e.g. UUIDs
+var validRequestID = regexp.MustCompile(`^[0-9A-Za-z_-]{1,64}$`)
+
+// Id from X-Request-Id of the request if it is valid, random otherwise
+func requestID(r *http.Request) string {
+	if id := r.Header.Get("X-Request-Id"); validRequestID.MatchString(id) {
+		return id
+	}
+
+	return newRequestID()
+}
+
+func newRequestID() string {
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return ""
+	}
+
+	return hex.EncodeToString(id)
+}
+
+func (i *RequestInfo) BodyBytes() int64 {
+	return atomic.LoadInt64(&i.bodyBytes)
+}
+
+func (i *RequestInfo) SetConcurrency(concurrency int) {
+	atomic.StoreInt32(&i.concurrency, int32(concurrency))
+}
+
+func (i *RequestInfo) Concurrency() int {
+	return int(atomic.LoadInt32(&i.concurrency))
+}
+
+// Marks the response as the outcome of a whole batch, not one of a timeout,
+// cancel or rejection
+func (i *RequestInfo) SetCompleted() {
+	atomic.StoreInt32(&i.completed, 1)
+}
+
+func (i *RequestInfo) Completed() bool {
+	return atomic.LoadInt32(&i.completed) == 1
+}
+
+// Info attached by loggingMiddleware, never nil
+func requestInfo(r *http.Request) *RequestInfo {
+	if info, ok := r.Context().Value(requestInfoKey{}).(*RequestInfo); ok {
+		return info
+	}
+
+	return &RequestInfo{ClientIP: r.RemoteAddr, Started: time.Now()}
+}
+
+func withRequestInfo(r *http.Request, info *RequestInfo) *http.Request {
+	r = r.WithContext(context.WithValue(r.Context(), requestInfoKey{}, info))
+	if r.Body != nil && r.Body != http.NoBody {
+		r.Body = &countingBody{ReadCloser: r.Body, count: &info.bodyBytes}
+	}
+
+	return r
+}
+
+type countingBody struct {
+	io.ReadCloser
+	count *int64
+}
+
+func (b *countingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	atomic.AddInt64(b.count, int64(n))
+	return n, err
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net/http"
+	neturl "net/url"
+	"strings"
+)
+
+// Client configuration a request may select
+type clientKey struct {
+	// Name of a -proxy-pool proxy, empty for the default -proxy
+	proxy    string
+	insecure bool
+}
+
+// Clients for every configuration requests may select, built at startup so
+// each keeps its own warm connection pool and transports are never
+// reconfigured per request. There is one client per named proxy, and with
+// -allow-insecure one more per proxy skipping TLS verification.
+type ClientPool struct {
+	clients    map[clientKey]*http.Client
+	transports []*http.Transport
+}
+
+// Parses comma separated name=url pairs of -proxy-pool
+func parseProxyPool(value string) (map[string]*neturl.URL, error) {
+	proxies := make(map[string]*neturl.URL)
+	for _, item := range strings.Split(value, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+
+		name, url, ok := strings.Cut(item, "=")
+		if !ok || name == "" {
+			return nil, fmt.Errorf("proxy \"%s\" must be given as name=url", item)
+		}
+
+		proxyUrl, err := neturl.Parse(url)
+		if err != nil || !proxyUrl.IsAbs() {
+			return nil, fmt.Errorf("invalid url of proxy \"%s\"", name)
+		}
+		proxies[name] = proxyUrl
+	}
+
+	return proxies, nil
+}
+
+func newClientPool(config Config, transport *http.Transport) (*ClientPool, error) {
+	proxies, err := parseProxyPool(config.ProxyPool)
+	if err != nil {
+		return nil, err
+	}
+
+	transports := map[clientKey]*http.Transport{{}: transport}
+	for name, proxyUrl := range proxies {
+		proxyTransport := transport.Clone()
+		// Credentials from the url are sent in Proxy-Authorization by the transport
+		proxyTransport.Proxy = http.ProxyURL(proxyUrl)
+		transports[clientKey{proxy: name}] = proxyTransport
+	}
+
+	if config.AllowInsecure {
+		for key, secure := range transports {
+			if key.insecure {
+				continue
+			}
+
+			insecure := secure.Clone()
+			insecure.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+			transports[clientKey{proxy: key.proxy, insecure: true}] = insecure
+		}
+	}
+
+	pool := &ClientPool{clients: make(map[clientKey]*http.Client, len(transports))}
+	for key, transport := range transports {
+		pool.clients[key] = &http.Client{
+			// Backstop only, urls are limited by their own timeouts
+			Timeout:       config.MaxFetchTimeout,
+			Transport:     limitHeaders(transport, config),
+			CheckRedirect: checkRedirect,
+		}
+		pool.transports = append(pool.transports, transport)
+	}
+
+	return pool, nil
+}
+
+// Client of the configuration, nil if it is not configured
+func (p *ClientPool) Get(key clientKey) *http.Client {
+	return p.clients[key]
+}
+
+// Transports of all clients, for idle connection cleanup
+func (p *ClientPool) Transports() []*http.Transport {
+	return p.transports
+}
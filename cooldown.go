@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// Cooldown after 429 without a usable Retry-After
+	DefaultHostCooldown = 1 * time.Second
+	MaxHostCooldown     = 5 * time.Minute
+)
+
+// Hosts that answered 429, fetches of them are paused until the cooldown
+// ends. Shared by all requests.
+type HostCooldowns struct {
+	mu    sync.Mutex
+	until map[string]time.Time
+}
+
+func newHostCooldowns() *HostCooldowns {
+	return &HostCooldowns{until: make(map[string]time.Time)}
+}
+
+// Parses Retry-After given either in seconds or as HTTP date
+func retryAfterDuration(value string) time.Duration {
+	if seconds, err := strconv.Atoi(value); err == nil && seconds >= 0 {
+		return time.Duration(seconds) * time.Second
+	}
+
+	if date, err := http.ParseTime(value); err == nil {
+		return time.Until(date)
+	}
+
+	return 0
+}
+
+// Starts cooldown of host from 429 response, keeps a longer one
+func (c *HostCooldowns) Throttled(host string, resp *http.Response) {
+	cooldown := retryAfterDuration(resp.Header.Get("Retry-After"))
+	if cooldown <= 0 {
+		cooldown = DefaultHostCooldown
+	}
+	if cooldown > MaxHostCooldown {
+		cooldown = MaxHostCooldown
+	}
+
+	until := time.Now().Add(cooldown)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if until.After(c.until[host]) {
+		c.until[host] = until
+	}
+}
+
+// Waits for the end of host cooldown. Fails at once when the cooldown
+// outlasts ctx, there is no point in waiting then.
+func (c *HostCooldowns) Wait(ctx context.Context, host string) error {
+	c.mu.Lock()
+	until, ok := c.until[host]
+	if ok && !time.Now().Before(until) {
+		delete(c.until, host)
+		ok = false
+	}
+	c.mu.Unlock()
+
+	if !ok {
+		return nil
+	}
+
+	if deadline, ok := ctx.Deadline(); ok && deadline.Before(until) {
+		return fmt.Errorf("host %s is rate limited for %s", host, time.Until(until).Round(time.Millisecond))
+	}
+
+	timer := time.NewTimer(time.Until(until))
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Remaining cooldown of hosts in ms
+func (c *HostCooldowns) Snapshot() map[string]int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	snapshot := make(map[string]int64, len(c.until))
+	for host, until := range c.until {
+		if !now.Before(until) {
+			delete(c.until, host)
+			continue
+		}
+
+		snapshot[host] = until.Sub(now).Milliseconds()
+	}
+
+	return snapshot
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"io"
+	"strconv"
+)
+
+var csvColumns = []string{"url", "status_code", "bytes", "duration_ms", "sha256", "error"}
+
+// Writes one row per result, bodies are replaced by their size and hash.
+// A stream ended early gets a last row with empty url and the reason.
+type csvStreamWriter struct {
+	w *csv.Writer
+	// Size and hash columns are empty when bodies are discarded (status_only)
+	bodies  bool
+	started bool
+}
+
+func newCsvStreamWriter(w io.Writer, bodies bool) *csvStreamWriter {
+	writer := csv.NewWriter(w)
+	// Line breaks of RFC 4180
+	writer.UseCRLF = true
+	return &csvStreamWriter{w: writer, bodies: bodies}
+}
+
+func (s *csvStreamWriter) writeRow(row []string) error {
+	if !s.started {
+		s.started = true
+		if err := s.w.Write(csvColumns); err != nil {
+			return err
+		}
+	}
+
+	if err := s.w.Write(row); err != nil {
+		return err
+	}
+
+	s.w.Flush()
+	return s.w.Error()
+}
+
+// Result is a TaskResult, fields are not allowed with csv
+func (s *csvStreamWriter) WriteResult(data interface{}) error {
+	result := data.(TaskResult)
+	size, hash := "", ""
+	if result.Err == nil && s.bodies {
+		body, err := decodeBody(result)
+		if err != nil {
+			return err
+		}
+
+		size = strconv.Itoa(len(body))
+		hash = bodyHash(string(body))
+	}
+
+	status := ""
+	if result.StatusCode != 0 {
+		status = strconv.Itoa(result.StatusCode)
+	}
+
+	return s.writeRow([]string{
+		result.Url,
+		status,
+		size,
+		strconv.FormatInt(result.DurationMs, 10),
+		hash,
+		result.Error,
+	})
+}
+
+// Rows have fixed columns
+func (s *csvStreamWriter) WriteProgress(ProgressEvent) error {
+	return nil
+}
+
+// Nothing can be inserted between rows
+func (s *csvStreamWriter) Heartbeat() error {
+	return nil
+}
+
+func (s *csvStreamWriter) Close(ctx context.Context, err error, terminatedEarly bool) error {
+	if err != nil || terminatedEarly {
+		status := streamStatus(ctx, err, terminatedEarly)
+		return s.writeRow([]string{"", "", "", "", "", status["reason"].(string)})
+	}
+
+	if !s.started {
+		// Header only, so an empty result is still a valid table
+		s.started = true
+		if err := s.w.Write(csvColumns); err != nil {
+			return err
+		}
+		s.w.Flush()
+		return s.w.Error()
+	}
+
+	return nil
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"hash"
+	"io"
+)
+
+// Hashes body while it is read, so the hash costs no second pass
+type hashingReader struct {
+	io.Reader
+	hash hash.Hash
+}
+
+func newHashingReader(r io.Reader) *hashingReader {
+	h := sha256.New()
+	return &hashingReader{Reader: io.TeeReader(r, h), hash: h}
+}
+
+func (r *hashingReader) Sum() string {
+	return hex.EncodeToString(r.hash.Sum(nil))
+}
+
+func bodyHash(body string) string {
+	sum := sha256.Sum256([]byte(body))
+	return hex.EncodeToString(sum[:])
+}
+
+// Urls with identical bodies, groups of one are left out
+type DuplicateGroup struct {
+	SHA256 string   `json:"sha256"`
+	Urls   []string `json:"urls"`
+}
+
+// Groups results by body hash in the order of first appearance. Results
+// without hash (failed, truncated) are not compared.
+func findDuplicates(results []TaskResult) []DuplicateGroup {
+	groups := make(map[string]int)
+	var all []DuplicateGroup
+	for _, result := range results {
+		if result.SHA256 == "" {
+			continue
+		}
+
+		i, ok := groups[result.SHA256]
+		if !ok {
+			i = len(all)
+			groups[result.SHA256] = i
+			all = append(all, DuplicateGroup{SHA256: result.SHA256})
+		}
+		all[i].Urls = append(all[i].Urls, result.Url)
+	}
+
+	duplicates := []DuplicateGroup{}
+	for _, group := range all {
+		if len(group.Urls) > 1 {
+			duplicates = append(duplicates, group)
+		}
+	}
+
+	return duplicates
+}
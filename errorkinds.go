@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"net"
+	"syscall"
+)
+
+// Kinds of url failures, see errorKind
+const (
+	ErrorKindTimeout     = "timeout"
+	ErrorKindDNS         = "dns"
+	ErrorKindRefused     = "connection_refused"
+	ErrorKindReset       = "connection_reset"
+	ErrorKindTLS         = "tls"
+	ErrorKindStatus      = "status"
+	ErrorKindSoftFailure = "soft_failure"
+	ErrorKindHeaderLimit = "header_limit"
+	ErrorKindCanceled    = "canceled"
+	ErrorKindOther       = "other"
+)
+
+// Machine-readable kind of url failure, the error text may change
+func errorKind(err error) string {
+	var dnsErr *DNSError
+	var statusErr *StatusError
+	var softErr *SoftFailureError
+	var headerErr *HeaderLimitError
+	var netErr net.Error
+	var certErr *tls.CertificateVerificationError
+	var unknownAuthority x509.UnknownAuthorityError
+	var recordErr tls.RecordHeaderError
+
+	switch {
+	case errors.As(err, &dnsErr):
+		return ErrorKindDNS
+	case errors.As(err, &statusErr):
+		return ErrorKindStatus
+	case errors.As(err, &softErr):
+		return ErrorKindSoftFailure
+	case errors.As(err, &headerErr):
+		return ErrorKindHeaderLimit
+	case errors.Is(err, context.Canceled):
+		return ErrorKindCanceled
+	case errors.Is(err, context.DeadlineExceeded), errors.Is(err, errStalledTransfer),
+		errors.As(err, &netErr) && netErr.Timeout():
+		return ErrorKindTimeout
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return ErrorKindRefused
+	case isConnectionReset(err):
+		return ErrorKindReset
+	case errors.As(err, &certErr), errors.As(err, &unknownAuthority), errors.As(err, &recordErr):
+		return ErrorKindTLS
+	}
+
+	return ErrorKindOther
+}
+
+// Failures of one kind in a batch
+type ErrorSummary struct {
+	Count int `json:"count"`
+	// First failed url of the kind
+	SampleUrl string `json:"sample_url"`
+}
+
+func summarizeErrors(results []TaskResult) map[string]*ErrorSummary {
+	summary := make(map[string]*ErrorSummary)
+	for _, result := range results {
+		if result.Err == nil {
+			continue
+		}
+
+		kind := summary[result.ErrorKind]
+		if kind == nil {
+			kind = &ErrorSummary{SampleUrl: result.Url}
+			summary[result.ErrorKind] = kind
+		}
+		kind.Count++
+	}
+
+	return summary
+}
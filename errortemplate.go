@@ -0,0 +1,76 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+)
+
+// Shape of error responses. String values "$code", "$reason" and "$status"
+// are replaced with the error code, reason and HTTP status of the error.
+const DefaultErrorTemplate = `{"success": false, "error_code": "$code", "reason": "$reason"}`
+
+// Parsed -error-template, set once at startup
+var errorTemplate = mustParseErrorTemplate(DefaultErrorTemplate)
+
+func mustParseErrorTemplate(data string) interface{} {
+	template, err := parseErrorTemplate([]byte(data))
+	if err != nil {
+		panic(err)
+	}
+
+	return template
+}
+
+func parseErrorTemplate(data []byte) (interface{}, error) {
+	var template interface{}
+	if err := json.Unmarshal(data, &template); err != nil {
+		return nil, fmt.Errorf("invalid error template: %w", err)
+	}
+
+	return template, nil
+}
+
+func loadErrorTemplate(path string) (interface{}, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	return parseErrorTemplate(data)
+}
+
+// Renders error response body from errorTemplate
+func errorBody(statusCode int, code ErrorCode, reason string) interface{} {
+	return renderErrorTemplate(errorTemplate, statusCode, code, reason)
+}
+
+func renderErrorTemplate(template interface{}, statusCode int, code ErrorCode, reason string) interface{} {
+	switch value := template.(type) {
+	case map[string]interface{}:
+		rendered := make(map[string]interface{}, len(value))
+		for key, item := range value {
+			rendered[key] = renderErrorTemplate(item, statusCode, code, reason)
+		}
+		return rendered
+
+	case []interface{}:
+		rendered := make([]interface{}, len(value))
+		for i, item := range value {
+			rendered[i] = renderErrorTemplate(item, statusCode, code, reason)
+		}
+		return rendered
+
+	case string:
+		switch value {
+		case "$code":
+			return code
+		case "$reason":
+			return reason
+		case "$status":
+			return statusCode
+		}
+	}
+
+	return template
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	neturl "net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// Events waiting for the publisher, later ones are dropped
+	EventQueueSize     = 1000
+	EventDialTimeout   = 5 * time.Second
+	EventWriteTimeout  = 5 * time.Second
+	DefaultEventsTopic = "multiplexer.requests"
+)
+
+// Published after each request completes
+type CompletionEvent struct {
+	RequestID  string    `json:"request_id"`
+	Urls       int       `json:"urls"`
+	Succeeded  int       `json:"succeeded"`
+	Failed     int       `json:"failed"`
+	DurationMs int64     `json:"duration_ms"`
+	Completed  time.Time `json:"completed"`
+}
+
+// Transport of completion events to a message queue
+type EventPublisher interface {
+	Publish(event CompletionEvent) error
+}
+
+type noopPublisher struct{}
+
+func (noopPublisher) Publish(CompletionEvent) error {
+	return nil
+}
+
+// Publisher of -events-url, no-op if it is empty. Only NATS is supported.
+func newEventPublisher(config Config) (EventPublisher, error) {
+	if config.EventsUrl == "" {
+		return noopPublisher{}, nil
+	}
+
+	url, err := neturl.Parse(config.EventsUrl)
+	if err != nil {
+		return nil, err
+	}
+
+	switch url.Scheme {
+	case "nats":
+		return newAsyncPublisher(&natsPublisher{addr: url.Host, subject: config.EventsTopic}), nil
+	}
+
+	return nil, fmt.Errorf("unsupported events url scheme \"%s\"", url.Scheme)
+}
+
+// Publishes from a background goroutine, so responses never wait for the
+// queue. Events are dropped when the queue is down long enough to fill up.
+type asyncPublisher struct {
+	events chan CompletionEvent
+}
+
+func newAsyncPublisher(publisher EventPublisher) *asyncPublisher {
+	p := &asyncPublisher{events: make(chan CompletionEvent, EventQueueSize)}
+	go func() {
+		for event := range p.events {
+			if err := publisher.Publish(event); err != nil {
+				log.Printf("Failed to publish completion of request \"%s\" : %s", event.RequestID, err)
+			}
+		}
+	}()
+
+	return p
+}
+
+func (p *asyncPublisher) Publish(event CompletionEvent) error {
+	select {
+	case p.events <- event:
+		return nil
+	default:
+		return fmt.Errorf("event queue is full")
+	}
+}
+
+// Core NATS protocol publisher, reconnects after errors. Server pings are
+// answered by a reader goroutine of each connection.
+type natsPublisher struct {
+	addr    string
+	subject string
+
+	mu   sync.Mutex
+	conn net.Conn
+}
+
+func (p *natsPublisher) connect() error {
+	conn, err := net.DialTimeout("tcp", p.addr, EventDialTimeout)
+	if err != nil {
+		return err
+	}
+
+	if _, err := fmt.Fprintf(conn, "CONNECT {\"verbose\":false,\"pedantic\":false,\"name\":\"multiplexer\"}\r\n"); err != nil {
+		conn.Close()
+		return err
+	}
+
+	p.conn = conn
+	go p.readLoop(conn)
+	return nil
+}
+
+func (p *natsPublisher) readLoop(conn net.Conn) {
+	reader := bufio.NewReader(conn)
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return
+		}
+
+		switch {
+		case strings.HasPrefix(line, "PING"):
+			p.mu.Lock()
+			_, err = conn.Write([]byte("PONG\r\n"))
+			p.mu.Unlock()
+		case strings.HasPrefix(line, "-ERR"):
+			log.Printf("NATS server %s error: %s", p.addr, strings.TrimSpace(line))
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+func (p *natsPublisher) Publish(event CompletionEvent) error {
+	payload, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.conn == nil {
+		if err := p.connect(); err != nil {
+			return err
+		}
+	}
+
+	message := append([]byte(fmt.Sprintf("PUB %s %d\r\n", p.subject, len(payload))), payload...)
+	message = append(message, "\r\n"...)
+	p.conn.SetWriteDeadline(time.Now().Add(EventWriteTimeout))
+	if _, err := p.conn.Write(message); err != nil {
+		p.conn.Close()
+		p.conn = nil
+		return err
+	}
+
+	return nil
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+)
+
+// Short names of result fields accepted in "fields" besides the json ones
+var resultFieldAliases = map[string]string{
+	"status":   "status_code",
+	"duration": "duration_ms",
+	"body":     "result",
+	"error":    "err",
+}
+
+// Json names of struct fields given in tags
+func jsonFieldNames(t reflect.Type) map[string]bool {
+	fields := make(map[string]bool)
+	for i := 0; i < t.NumField(); i++ {
+		name := strings.Split(t.Field(i).Tag.Get("json"), ",")[0]
+		if name != "" && name != "-" {
+			fields[name] = true
+		}
+	}
+
+	return fields
+}
+
+var resultFields = jsonFieldNames(reflect.TypeOf(TaskResult{}))
+
+// Validates requested field names and maps aliases to json names
+func parseFields(names []string) ([]string, error) {
+	fields := make([]string, 0, len(names))
+	for _, name := range names {
+		if alias, ok := resultFieldAliases[name]; ok {
+			name = alias
+		}
+
+		if !resultFields[name] {
+			return nil, fmt.Errorf("unknown result field \"%s\"", name)
+		}
+
+		fields = append(fields, name)
+	}
+
+	return fields, nil
+}
+
+// Result marshalled with requested fields only. Holds a pointer, so bodies
+// dropped after projection are not returned either.
+type projectedResult struct {
+	result *TaskResult
+	fields []string
+}
+
+func (p projectedResult) MarshalJSON() ([]byte, error) {
+	data, err := json.Marshal(p.result)
+	if err != nil {
+		return nil, err
+	}
+
+	var all map[string]json.RawMessage
+	if err := json.Unmarshal(data, &all); err != nil {
+		return nil, err
+	}
+
+	projected := make(map[string]json.RawMessage, len(p.fields))
+	for _, name := range p.fields {
+		// Empty omitempty fields are missing anyway
+		if value, ok := all[name]; ok {
+			projected[name] = value
+		}
+	}
+
+	return json.Marshal(projected)
+}
+
+// Returns result as is when all fields are requested (fields is nil)
+func projectResult(result TaskResult, fields []string) interface{} {
+	if fields == nil {
+		return result
+	}
+
+	return projectedResult{result: &result, fields: fields}
+}
+
+func projectResults(results []TaskResult, fields []string) interface{} {
+	if fields == nil {
+		return results
+	}
+
+	projected := make([]projectedResult, len(results))
+	for i := range results {
+		projected[i] = projectedResult{result: &results[i], fields: fields}
+	}
+
+	return projected
+}
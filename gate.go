@@ -0,0 +1,46 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// Leaky bucket spacing out starts of downstream fetches, so a burst of
+// requests ramps up gradually instead of hitting downstreams all at once
+type StartGate struct {
+	interval time.Duration
+
+	mu   sync.Mutex
+	next time.Time
+}
+
+func newStartGate(ratePerSecond float64) *StartGate {
+	return &StartGate{interval: time.Duration(float64(time.Second) / ratePerSecond)}
+}
+
+// Blocks until the caller's turn to start a fetch
+func (g *StartGate) Wait(ctx context.Context) error {
+	g.mu.Lock()
+	now := time.Now()
+	if g.next.Before(now) {
+		g.next = now
+	}
+	wait := g.next.Sub(now)
+	g.next = g.next.Add(g.interval)
+	g.mu.Unlock()
+
+	if wait <= 0 {
+		return nil
+	}
+
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
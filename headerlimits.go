@@ -0,0 +1,59 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+)
+
+const (
+	DefaultMaxResponseHeaders     = 200
+	DefaultMaxResponseHeaderBytes = 64 << 10
+)
+
+// Downstream response rejected for too many or too large headers
+type HeaderLimitError struct {
+	Count int
+	Bytes int
+	Limit string
+}
+
+func (e *HeaderLimitError) Error() string {
+	return fmt.Sprintf("response headers exceed the limit of %s (%d headers, ~%d bytes)", e.Limit, e.Count, e.Bytes)
+}
+
+// Rejects responses with more header lines than maxCount or, by estimate,
+// more header bytes than maxBytes. 0 disables a limit.
+type headerLimitTransport struct {
+	http.RoundTripper
+	maxCount int
+	maxBytes int
+}
+
+func (t *headerLimitTransport) RoundTrip(request *http.Request) (*http.Response, error) {
+	resp, err := t.RoundTripper.RoundTrip(request)
+	if err != nil {
+		return nil, err
+	}
+
+	// As sent on the wire: "Name: value\r\n" per value
+	count, size := 0, 0
+	for name, values := range resp.Header {
+		for _, value := range values {
+			count++
+			size += len(name) + len(value) + 4
+		}
+	}
+
+	limit := ""
+	if t.maxCount > 0 && count > t.maxCount {
+		limit = fmt.Sprintf("%d headers", t.maxCount)
+	} else if t.maxBytes > 0 && size > t.maxBytes {
+		limit = fmt.Sprintf("%d bytes", t.maxBytes)
+	}
+	if limit != "" {
+		resp.Body.Close()
+		return nil, &HeaderLimitError{Count: count, Bytes: size, Limit: limit}
+	}
+
+	return resp, nil
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// Headers describing the connection between two hops, or managed by the
+// transport itself. They can't be forwarded downstream.
+var forbiddenHeaders = map[string]bool{
+	"Connection":          true,
+	"Keep-Alive":          true,
+	"Proxy-Authenticate":  true,
+	"Proxy-Authorization": true,
+	"Proxy-Connection":    true,
+	"Te":                  true,
+	"Trailer":             true,
+	"Transfer-Encoding":   true,
+	"Upgrade":             true,
+	"Host":                true,
+	"Content-Length":      true,
+}
+
+func isTokenChar(c rune) bool {
+	return c < 0x7f && c > 0x20 && !strings.ContainsRune("\"(),/:;<=>?@[\\]{}", c)
+}
+
+// Validates client supplied headers and converts them to http.Header
+func parseHeaders(headers map[string]string) (http.Header, error) {
+	ret := make(http.Header, len(headers))
+	for name, value := range headers {
+		if name == "" || strings.IndexFunc(name, func(c rune) bool { return !isTokenChar(c) }) >= 0 {
+			return nil, fmt.Errorf("invalid header name %q", name)
+		}
+
+		if strings.ContainsAny(value, "\r\n\x00") {
+			return nil, fmt.Errorf("invalid value of header %q", name)
+		}
+
+		name = http.CanonicalHeaderKey(name)
+		if forbiddenHeaders[name] {
+			return nil, fmt.Errorf("header %q can't be forwarded", name)
+		}
+
+		ret.Set(name, value)
+	}
+
+	return ret, nil
+}
+
+// Cookie-octet of RFC 6265
+func isCookieValueChar(c rune) bool {
+	return c < 0x7f && c > 0x20 && !strings.ContainsRune("\",;\\", c)
+}
+
+// Validates client supplied cookies and joins them into a Cookie header
+// value, sorted by name so equal sets share cache entries
+func parseCookies(cookies map[string]string) (string, error) {
+	names := make([]string, 0, len(cookies))
+	for name, value := range cookies {
+		if name == "" || strings.IndexFunc(name, func(c rune) bool { return !isTokenChar(c) }) >= 0 {
+			return "", fmt.Errorf("invalid cookie name %q", name)
+		}
+
+		if strings.IndexFunc(value, func(c rune) bool { return !isCookieValueChar(c) }) >= 0 {
+			return "", fmt.Errorf("invalid value of cookie %q", name)
+		}
+
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	pairs := make([]string, 0, len(names))
+	for _, name := range names {
+		pairs = append(pairs, name+"="+cookies[name])
+	}
+
+	return strings.Join(pairs, "; "), nil
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Counts of observed durations by upper bucket bound
+type Histogram struct {
+	bounds []time.Duration
+
+	mu     sync.Mutex
+	counts []int64
+	sum    time.Duration
+	total  int64
+}
+
+func newHistogram(bounds ...time.Duration) *Histogram {
+	return &Histogram{
+		bounds: bounds,
+		// Last bucket counts everything above the largest bound
+		counts: make([]int64, len(bounds)+1),
+	}
+}
+
+func (h *Histogram) Observe(d time.Duration) {
+	i := 0
+	for i < len(h.bounds) && d > h.bounds[i] {
+		i++
+	}
+
+	h.mu.Lock()
+	h.counts[i]++
+	h.sum += d
+	h.total++
+	h.mu.Unlock()
+}
+
+func (h *Histogram) Snapshot() map[string]interface{} {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	buckets := make(map[string]int64, len(h.counts))
+	for i, count := range h.counts {
+		le := "+Inf"
+		if i < len(h.bounds) {
+			le = fmt.Sprintf("%d", h.bounds[i].Milliseconds())
+		}
+		buckets[le] = count
+	}
+
+	return map[string]interface{}{
+		"buckets_le_ms": buckets,
+		"count":         h.total,
+		"sum_ms":        h.sum.Milliseconds(),
+	}
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"sync"
+)
+
+// Global cap on in-flight fetches per host, summed across all requests.
+// Unlike per-request scheme slots, a host shared by many batches still gets
+// no more than max fetches at once.
+type HostSlots struct {
+	max   int
+	mu    sync.Mutex
+	hosts map[string]*hostSlot
+}
+
+type hostSlot struct {
+	slots chan struct{}
+	// Fetches holding or waiting for a slot, the host is dropped at 0
+	users int
+}
+
+func newHostSlots(max int) *HostSlots {
+	return &HostSlots{max: max, hosts: make(map[string]*hostSlot)}
+}
+
+// Waits for a slot of host until ctx is done. Release must be called once
+// the fetch is over.
+func (s *HostSlots) Acquire(ctx context.Context, host string) (release func(), err error) {
+	s.mu.Lock()
+	slot, ok := s.hosts[host]
+	if !ok {
+		slot = &hostSlot{slots: make(chan struct{}, s.max)}
+		s.hosts[host] = slot
+	}
+	slot.users++
+	s.mu.Unlock()
+
+	done := func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		slot.users--
+		if slot.users == 0 {
+			delete(s.hosts, host)
+		}
+	}
+
+	select {
+	case slot.slots <- struct{}{}:
+		return func() {
+			<-slot.slots
+			done()
+		}, nil
+	case <-ctx.Done():
+		done()
+		return nil, ctx.Err()
+	}
+}
+
+// Acquire of slots that may be nil, release is a no-op then
+func acquireHostSlot(ctx context.Context, slots *HostSlots, host string) (release func(), err error) {
+	if slots == nil {
+		return func() {}, nil
+	}
+
+	return slots.Acquire(ctx, host)
+}
+
+// In-flight fetches per host
+func (s *HostSlots) Snapshot() map[string]int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	snapshot := make(map[string]int, len(s.hosts))
+	for host, slot := range s.hosts {
+		if inFlight := len(slot.slots); inFlight > 0 {
+			snapshot[host] = inFlight
+		}
+	}
+
+	return snapshot
+}
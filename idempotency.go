@@ -0,0 +1,141 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	// Bodies of requests with Idempotency-Key are read upfront to compare them
+	MaxIdempotentBodyBytes  = 1 << 20
+	MaxIdempotencyKeyLength = 256
+)
+
+// Responses of requests with Idempotency-Key, so clients retrying a batch get
+// the response of the first attempt instead of fetching urls again. Keys are
+// scoped per tenant. Only outcomes of completed batches are kept, retrying
+// anything else runs the request again.
+type IdempotencyKeys struct {
+	ttl time.Duration
+	// Keyed by tenantScopedId of tenant and key
+	store ResultStore
+
+	mu       sync.Mutex
+	inFlight map[string]bool
+}
+
+func newIdempotencyKeys(ttl time.Duration) *IdempotencyKeys {
+	return &IdempotencyKeys{
+		ttl:      ttl,
+		store:    &memoryResultStore{results: make(map[string]StoredResult)},
+		inFlight: make(map[string]bool),
+	}
+}
+
+func (k *IdempotencyKeys) begin(id string) bool {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	if k.inFlight[id] {
+		return false
+	}
+
+	k.inFlight[id] = true
+	return true
+}
+
+func (k *IdempotencyKeys) end(id string) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	delete(k.inFlight, id)
+}
+
+func replayResponse(w http.ResponseWriter, result StoredResult) error {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Idempotent-Replayed", "true")
+	w.WriteHeader(result.Status)
+	if _, err := w.Write(result.Body); err != nil {
+		log.Printf("Failed to write response to client: %s", err)
+	}
+
+	return nil
+}
+
+// Serves batch requests with Idempotency-Key through the stored responses,
+// requests without it go to next as is
+func (h *Handler) idempotent(next func(http.ResponseWriter, *http.Request) error) func(http.ResponseWriter, *http.Request) error {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		key := r.Header.Get("Idempotency-Key")
+		if key == "" || r.Method != "POST" {
+			return next(w, r)
+		}
+
+		if len(key) > MaxIdempotencyKeyLength {
+			return errorResponse(w, 400, ErrorInvalidRequest, fmt.Sprintf("Idempotency-Key must not exceed %d characters", MaxIdempotencyKeyLength))
+		}
+
+		// Streams are not kept, their responses may be huge
+		if format, err := streamFormat(r); err != nil || format != "" {
+			return errorResponse(w, 400, ErrorInvalidRequest, "Idempotency-Key requires a batch response")
+		}
+
+		body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, MaxIdempotentBodyBytes))
+		if err != nil {
+			return errorResponse(w, 400, ErrorInvalidRequest, fmt.Sprintf("Request with Idempotency-Key must not exceed %d bytes", MaxIdempotentBodyBytes))
+		}
+		r.Body = ioutil.NopCloser(bytes.NewReader(body))
+		fingerprint := bodyHash(string(body))
+
+		id := tenantScopedId(h.tenantOf(r), key)
+		stored, ok, err := h.idempotency.store.Get(id)
+		if err != nil {
+			return fmt.Errorf("failed to read idempotent response: %w", err)
+		}
+		if ok {
+			if stored.Fingerprint != fingerprint {
+				return errorResponse(w, 422, ErrorIdempotencyMismatch, "Idempotency-Key was used with another request body")
+			}
+			return replayResponse(w, stored)
+		}
+
+		if !h.idempotency.begin(id) {
+			return errorResponse(w, 409, ErrorIdempotencyConflict, "Request with this Idempotency-Key is in progress")
+		}
+		defer h.idempotency.end(id)
+
+		recorder := &resultRecorder{ResponseWriter: w}
+		w.Header().Set("Idempotent-Replayed", "false")
+		if err := next(recorder, r); err != nil {
+			return err
+		}
+
+		// Only outcomes of whole batches are replayed. Those of disconnects,
+		// timeouts and cancels would fail every retry for the ttl.
+		if !requestInfo(r).Completed() || r.Context().Err() != nil {
+			return nil
+		}
+		if recorder.status == 0 || recorder.status >= 500 || !json.Valid(recorder.body) {
+			return nil
+		}
+
+		result := StoredResult{
+			Tenant:      h.tenantOf(r),
+			Status:      recorder.status,
+			Expires:     time.Now().Add(h.idempotency.ttl),
+			Body:        recorder.body,
+			Fingerprint: fingerprint,
+		}
+		if err := h.idempotency.store.Put(id, result); err != nil {
+			log.Printf("Failed to store idempotent response of request \"%s\" : %s", requestInfo(r).ID, err)
+		}
+
+		return nil
+	}
+}
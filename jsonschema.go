@@ -0,0 +1,200 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+)
+
+const JSONSchemaDialect = "https://json-schema.org/draft/2020-12/schema"
+
+var (
+	timeType       = reflect.TypeOf(time.Time{})
+	rawMessageType = reflect.TypeOf(json.RawMessage{})
+	urlEntryType   = reflect.TypeOf(UrlEntry{})
+)
+
+// Builds JSON Schema of Go types from their json tags, named structs go to
+// defs and are referenced. With required, fields without omitempty are
+// required, which holds for responses but not for requests.
+type schemaBuilder struct {
+	defs     map[string]interface{}
+	required bool
+}
+
+func (b *schemaBuilder) typeSchema(t reflect.Type) interface{} {
+	switch {
+	case t == timeType:
+		return map[string]interface{}{"type": "string", "format": "date-time"}
+	case t == rawMessageType:
+		return map[string]interface{}{}
+	case t == urlEntryType:
+		// Plain url or object, see UrlEntry.UnmarshalJSON
+		return map[string]interface{}{
+			"anyOf": []interface{}{map[string]interface{}{"type": "string"}, b.structRef(t)},
+		}
+	}
+
+	switch t.Kind() {
+	case reflect.Ptr:
+		return b.typeSchema(t.Elem())
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]interface{}{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case reflect.Slice, reflect.Array:
+		return map[string]interface{}{"type": "array", "items": b.typeSchema(t.Elem())}
+	case reflect.Map:
+		return map[string]interface{}{"type": "object", "additionalProperties": b.typeSchema(t.Elem())}
+	case reflect.Struct:
+		return b.structRef(t)
+	}
+
+	// Interfaces hold any json
+	return map[string]interface{}{}
+}
+
+func (b *schemaBuilder) structRef(t reflect.Type) interface{} {
+	if _, ok := b.defs[t.Name()]; !ok {
+		// Placeholder stops recursion of self-referencing types
+		b.defs[t.Name()] = nil
+		b.defs[t.Name()] = b.structSchema(t)
+	}
+
+	return map[string]interface{}{"$ref": "#/$defs/" + t.Name()}
+}
+
+func (b *schemaBuilder) structSchema(t reflect.Type) map[string]interface{} {
+	properties := make(map[string]interface{})
+	required := []string{}
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		tag := strings.Split(field.Tag.Get("json"), ",")
+		if !field.IsExported() || tag[0] == "" || tag[0] == "-" {
+			continue
+		}
+
+		properties[tag[0]] = b.typeSchema(field.Type)
+		if b.required && !strings.Contains(field.Tag.Get("json"), ",omitempty") {
+			required = append(required, tag[0])
+		}
+	}
+
+	schema := map[string]interface{}{"type": "object", "properties": properties}
+	if len(required) > 0 {
+		schema["required"] = required
+	}
+
+	return schema
+}
+
+// Schema of error responses, follows -error-template
+func errorTemplateSchema(template interface{}) interface{} {
+	switch value := template.(type) {
+	case map[string]interface{}:
+		properties := make(map[string]interface{}, len(value))
+		required := make([]string, 0, len(value))
+		for key, item := range value {
+			properties[key] = errorTemplateSchema(item)
+			required = append(required, key)
+		}
+		sort.Strings(required)
+		return map[string]interface{}{"type": "object", "properties": properties, "required": required}
+
+	case []interface{}:
+		items := make([]interface{}, len(value))
+		for i, item := range value {
+			items[i] = errorTemplateSchema(item)
+		}
+		return map[string]interface{}{"type": "array", "prefixItems": items}
+
+	case string:
+		if value == "$status" {
+			return map[string]interface{}{"type": "integer"}
+		}
+		if value == "$code" || value == "$reason" {
+			return map[string]interface{}{"type": "string"}
+		}
+	}
+
+	return map[string]interface{}{"const": template}
+}
+
+// JSON Schema of requests and responses, generated from the types so it
+// follows them. Envelopes built as maps are described here and have to be
+// kept in sync with onRequest.
+func responseSchema() map[string]interface{} {
+	requests := &schemaBuilder{defs: make(map[string]interface{})}
+	requests.structRef(reflect.TypeOf(Request{}))
+
+	responses := &schemaBuilder{defs: make(map[string]interface{}), required: true}
+	ref := func(v interface{}) interface{} {
+		return responses.typeSchema(reflect.TypeOf(v))
+	}
+	object := func(properties map[string]interface{}) interface{} {
+		return map[string]interface{}{"type": "object", "properties": properties}
+	}
+	anyObject := map[string]interface{}{"type": "object"}
+
+	defs := responses.defs
+	defs["BatchResponse"] = map[string]interface{}{
+		"type":     "object",
+		"required": []string{"success", "result"},
+		"properties": map[string]interface{}{
+			"success":            map[string]interface{}{"const": true},
+			"result":             ref([]TaskResult{}),
+			"applied":            anyObject,
+			"succeeded":          map[string]interface{}{"type": "integer"},
+			"duplicates":         ref([]DuplicateGroup{}),
+			"error_summary":      ref(map[string]ErrorSummary{}),
+			"metrics":            anyObject,
+			"request_info":       anyObject,
+			"response_truncated": map[string]interface{}{"type": "boolean"},
+		},
+	}
+	// Timeouts, cancels and unmet min_success_* add partial results to the
+	// error, if it is an object
+	defs["ErrorResponse"] = errorTemplateSchema(errorTemplate)
+	defs["StreamLine"] = map[string]interface{}{
+		"description": "Line of ?stream=ndjson, element of ?stream=array: a result, a progress event or the final status",
+		"anyOf": []interface{}{
+			ref(TaskResult{}),
+			ref(ProgressEvent{}),
+			object(map[string]interface{}{
+				"success":          map[string]interface{}{"type": "boolean"},
+				"terminated_early": map[string]interface{}{"type": "boolean"},
+				"error_code":       map[string]interface{}{"type": "string"},
+				"reason":           map[string]interface{}{"type": "string"},
+			}),
+		},
+	}
+	for name, schema := range requests.defs {
+		defs[name] = schema
+	}
+
+	return map[string]interface{}{
+		"$schema": JSONSchemaDialect,
+		"$id":     "/schema",
+		"$defs":   defs,
+		"anyOf": []interface{}{
+			map[string]interface{}{"$ref": "#/$defs/BatchResponse"},
+			map[string]interface{}{"$ref": "#/$defs/ErrorResponse"},
+		},
+	}
+}
+
+func (h *Handler) onSchema(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != "GET" {
+		return errorResponse(w, 400, ErrorMethodNotAllowed, "Method not supported")
+	}
+
+	return jsonResponse(w, 200, responseSchema())
+}
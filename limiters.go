@@ -0,0 +1,176 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"sync"
+	"time"
+)
+
+// Limiter algorithms selected by -limiter
+const (
+	LimiterFixed       = "fixed"
+	LimiterAdaptive    = "adaptive"
+	LimiterLeakyBucket = "leaky-bucket"
+)
+
+const (
+	// Adaptive limit is decreased when requests take this many times longer
+	// than the baseline
+	AdaptiveLatencyTolerance = 2.0
+	AdaptiveDecreaseFactor   = 0.9
+	// Weight of a new sample in the short-term latency average, the baseline
+	// follows latency 20 times slower
+	AdaptiveSampleWeight   = 0.1
+	AdaptiveBaselineWeight = 0.005
+)
+
+// Admission of client requests. Acquire fails at once when the request is
+// not admitted. Release is given the time the slot was held, 0 if it says
+// nothing about downstream latency.
+type Limiter interface {
+	Acquire() error
+	Release(held time.Duration)
+	// Requests holding a slot
+	Active() int32
+	// Current limit of active requests
+	Limit() int32
+}
+
+func newLimiter(config Config) (Limiter, error) {
+	switch config.Limiter {
+	case LimiterFixed:
+		return &ClientLimiter{MaxConcurrentClients: MaxConcurrentClients}, nil
+	case LimiterAdaptive:
+		return newAdaptiveLimiter(MaxConcurrentClients), nil
+	case LimiterLeakyBucket:
+		return newLeakyBucketLimiter(MaxConcurrentClients, config.LimiterRate), nil
+	}
+
+	return nil, fmt.Errorf("unknown limiter \"%s\"", config.Limiter)
+}
+
+// AIMD limit driven by request latency: grows by one per limit of fast
+// requests and shrinks by AdaptiveDecreaseFactor when latency rises well above
+// the long-term baseline, i.e. downstreams slow down under the load.
+type AdaptiveLimiter struct {
+	mu       sync.Mutex
+	max      int32
+	limit    float64
+	active   int32
+	latency  float64
+	baseline float64
+	// Limit is not decreased again before requests admitted since the last
+	// decrease complete, one slow spell is one decrease
+	recoverAt time.Time
+}
+
+func newAdaptiveLimiter(max int32) *AdaptiveLimiter {
+	return &AdaptiveLimiter{max: max, limit: float64(max)}
+}
+
+func (l *AdaptiveLimiter) Acquire() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.active >= int32(l.limit) {
+		return fmt.Errorf("limit reached")
+	}
+
+	l.active++
+	return nil
+}
+
+func (l *AdaptiveLimiter) Release(held time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.active--
+	if held <= 0 {
+		return
+	}
+
+	sample := float64(held)
+	if l.baseline == 0 {
+		l.latency, l.baseline = sample, sample
+		return
+	}
+	l.latency += AdaptiveSampleWeight * (sample - l.latency)
+	l.baseline += AdaptiveBaselineWeight * (sample - l.baseline)
+
+	now := time.Now()
+	if l.latency > AdaptiveLatencyTolerance*l.baseline {
+		if now.After(l.recoverAt) {
+			l.limit = math.Max(1, l.limit*AdaptiveDecreaseFactor)
+			l.recoverAt = now.Add(held)
+		}
+		return
+	}
+
+	l.limit = math.Min(float64(l.max), l.limit+1/l.limit)
+}
+
+func (l *AdaptiveLimiter) Active() int32 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return l.active
+}
+
+func (l *AdaptiveLimiter) Limit() int32 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return int32(l.limit)
+}
+
+// Bucket of capacity requests leaking at rate per second, a request that
+// would overflow it is rejected. Smooths bursts into a steady admission rate,
+// concurrency is bounded by capacity as well.
+type LeakyBucketLimiter struct {
+	mu       sync.Mutex
+	capacity float64
+	rate     float64
+	level    float64
+	leaked   time.Time
+	active   int32
+}
+
+func newLeakyBucketLimiter(capacity int32, rate float64) *LeakyBucketLimiter {
+	return &LeakyBucketLimiter{capacity: float64(capacity), rate: rate, leaked: time.Now()}
+}
+
+func (l *LeakyBucketLimiter) Acquire() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	l.level = math.Max(0, l.level-now.Sub(l.leaked).Seconds()*l.rate)
+	l.leaked = now
+
+	if l.level+1 > l.capacity || float64(l.active) >= l.capacity {
+		return fmt.Errorf("limit reached")
+	}
+
+	l.level++
+	l.active++
+	return nil
+}
+
+func (l *LeakyBucketLimiter) Release(time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.active--
+}
+
+func (l *LeakyBucketLimiter) Active() int32 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return l.active
+}
+
+func (l *LeakyBucketLimiter) Limit() int32 {
+	return int32(l.capacity)
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// Log levels of a single request, see Request.LogLevel
+const (
+	LogLevelInfo  = "info"
+	LogLevelDebug = "debug"
+)
+
+// Writes debug messages of one request tagged with its id. A nil logger
+// writes nothing, so only requests asking for debug pay for it.
+type RequestLogger struct {
+	id string
+	// nil if bodies are not logged
+	bodies *BodySampler
+}
+
+func newRequestLogger(id, level string, bodies *BodySampler) *RequestLogger {
+	if level != LogLevelDebug {
+		return nil
+	}
+
+	return &RequestLogger{id: id, bodies: bodies}
+}
+
+func (l *RequestLogger) Debugf(format string, args ...interface{}) {
+	if l == nil {
+		return
+	}
+
+	log.Printf("DEBUG id=%s %s", l.id, fmt.Sprintf(format, args...))
+}
+
+// Logs prefix of a downloaded body if -log-body-bytes is set
+func (l *RequestLogger) DebugBody(url string, body []byte) {
+	if l == nil || l.bodies == nil {
+		return
+	}
+
+	l.Debugf("GET %s body %s", url, l.bodies.Sample(body))
+}
+
+// Hides secrets like "password=..", "token": ".." and bearer tokens
+const DefaultLogBodyRedact = `(?i)(password|passwd|secret|token|api_?key|authorization)["']?\s*[:=]\s*["']?[^"'&\s,;]+|bearer\s+[a-z0-9._~+/=-]+`
+
+// Secrets are searched a bit past the prefix, so one cut by it is still
+// recognized
+const RedactMarginBytes = 256
+
+// Formats body prefixes for logs, text quoted and binary hex encoded
+type BodySampler struct {
+	maxBytes int
+	redact   *regexp.Regexp
+}
+
+// nil if maxBytes is 0, an empty pattern hides nothing
+func newBodySampler(maxBytes int, redact string) (*BodySampler, error) {
+	if maxBytes == 0 {
+		return nil, nil
+	}
+
+	sampler := &BodySampler{maxBytes: maxBytes}
+	if redact != "" {
+		var err error
+		if sampler.redact, err = regexp.Compile(redact); err != nil {
+			return nil, err
+		}
+	}
+
+	return sampler, nil
+}
+
+func (s *BodySampler) Sample(body []byte) string {
+	window := body
+	if len(window) > s.maxBytes+RedactMarginBytes {
+		window = window[:s.maxBytes+RedactMarginBytes]
+	}
+	if s.redact != nil {
+		window = s.redact.ReplaceAll(window, []byte("<redacted>"))
+	}
+
+	sample := window
+	if len(sample) > s.maxBytes {
+		sample = sample[:s.maxBytes]
+		// Rune cut by the prefix doesn't make text binary
+		for i := 0; i < utf8.UTFMax-1 && !utf8.Valid(sample); i++ {
+			sample = sample[:len(sample)-1]
+		}
+	}
+
+	description := fmt.Sprintf("(%d bytes)", len(body))
+	if len(sample) < len(window) || len(window) < len(body) {
+		description = fmt.Sprintf("(first %d of %d bytes, TRUNCATED)", len(sample), len(body))
+	}
+
+	if !utf8.Valid(sample) || bytes.IndexByte(sample, 0) >= 0 {
+		return fmt.Sprintf("%s hex: %s", description, hex.EncodeToString(sample))
+	}
+
+	return fmt.Sprintf("%s text: %q", description, sample)
+}
+
+// Headers in one line, values of credentials are hidden
+func formatHeaders(header http.Header) string {
+	names := make([]string, 0, len(header))
+	for name := range header {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	parts := make([]string, 0, len(names))
+	for _, name := range names {
+		value := strings.Join(header[name], ", ")
+		switch name {
+		case "Authorization", "Cookie", "Set-Cookie", "Proxy-Authorization":
+			value = "<hidden>"
+		}
+		parts = append(parts, fmt.Sprintf("%s: %q", name, value))
+	}
+
+	return strings.Join(parts, "; ")
+}
+
+// Slowest urls listed in the slow request log line
+const SlowestUrlsLogged = 3
+
+// Logs batches slower than -slow-request-threshold with their slowest urls,
+// faster ones only at debug level of the request. Failed batches have results
+// of urls completed until the failure.
+func (h *Handler) logRequestDuration(r *http.Request, logger *RequestLogger, urls int, results []TaskResult) {
+	info := requestInfo(r)
+	took := time.Since(info.Started)
+	if h.config.SlowRequestThreshold <= 0 || took < h.config.SlowRequestThreshold {
+		logger.Debugf("request of %d urls took %s", urls, took)
+		return
+	}
+
+	slowest := make([]TaskResult, len(results))
+	copy(slowest, results)
+	sort.SliceStable(slowest, func(i, j int) bool {
+		return slowest[i].DurationMs > slowest[j].DurationMs
+	})
+	if len(slowest) > SlowestUrlsLogged {
+		slowest = slowest[:SlowestUrlsLogged]
+	}
+
+	parts := []string{"none"}
+	if len(slowest) > 0 {
+		parts = make([]string, len(slowest))
+	}
+	for i, result := range slowest {
+		parts[i] = fmt.Sprintf("%s (%dms)", result.Url, result.DurationMs)
+	}
+
+	log.Printf("WARNING: slow request id=%s from %s: %d urls took %s, %d completed, slowest: %s", info.ID, info.ClientIP, urls, took, len(results), strings.Join(parts, ", "))
+}
@@ -0,0 +1,402 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// Options of a plain fetch, as newDownloadOptions sets them for an empty request
+func testOptions() DownloadOptions {
+	return DownloadOptions{
+		Timeout:      5 * time.Second,
+		MaxTimeout:   5 * time.Second,
+		MaxBodyBytes: MaxBodyBytesPerUrl,
+		Encoding:     EncodingAuto,
+	}
+}
+
+// Server answering every request with body, counting connections it accepted
+func newCountingServer(t *testing.T, body string) (*httptest.Server, *int32) {
+	t.Helper()
+
+	var conns int32
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(body))
+	}))
+	server.Config.ConnState = func(_ net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			atomic.AddInt32(&conns, 1)
+		}
+	}
+	server.Start()
+	t.Cleanup(server.Close)
+
+	return server, &conns
+}
+
+func TestNewTransportKeepAlive(t *testing.T) {
+	tests := []struct {
+		name             string
+		disableKeepAlive bool
+		wantConns        int32
+	}{
+		{name: "default reuses connection", disableKeepAlive: false, wantConns: 1},
+		{name: "disabled opens connection per fetch", disableKeepAlive: true, wantConns: 3},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			transport, err := newTransport(Config{DisableKeepAlive: test.disableKeepAlive})
+			if err != nil {
+				t.Fatalf("newTransport: %v", err)
+			}
+			defer transport.CloseIdleConnections()
+
+			if transport.DisableKeepAlives != test.disableKeepAlive {
+				t.Errorf("DisableKeepAlives = %t, want %t", transport.DisableKeepAlives, test.disableKeepAlive)
+			}
+
+			server, conns := newCountingServer(t, "ok")
+			client := &http.Client{Transport: transport}
+			for i := 0; i < 3; i++ {
+				if _, err := downloadUrl(context.Background(), client, server.URL, testOptions()); err != nil {
+					t.Fatalf("downloadUrl: %v", err)
+				}
+			}
+
+			if got := atomic.LoadInt32(conns); got != test.wantConns {
+				t.Errorf("server accepted %d connections, want %d", got, test.wantConns)
+			}
+		})
+	}
+}
+
+func TestNoContentResponses(t *testing.T) {
+	tests := []struct {
+		name          string
+		status        int
+		body          string
+		acceptStatus  map[int]bool
+		wantNoContent bool
+	}{
+		{name: "204", status: 204, wantNoContent: true},
+		{name: "304 accepted", status: 304, acceptStatus: map[int]bool{304: true}, wantNoContent: true},
+		{name: "empty 200", status: 200},
+		{name: "200 with body", status: 200, body: "content"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(test.status)
+				w.Write([]byte(test.body))
+			}))
+			defer server.Close()
+
+			opts := testOptions()
+			opts.AcceptStatus = test.acceptStatus
+			result, err := downloadUrl(context.Background(), server.Client(), server.URL, opts)
+			if err != nil {
+				t.Fatalf("downloadUrl: %v", err)
+			}
+
+			if result.StatusCode != test.status {
+				t.Errorf("StatusCode = %d, want %d", result.StatusCode, test.status)
+			}
+			if result.NoContent != test.wantNoContent {
+				t.Errorf("NoContent = %t, want %t", result.NoContent, test.wantNoContent)
+			}
+			if result.Result != test.body {
+				t.Errorf("Result = %q, want %q", result.Result, test.body)
+			}
+		})
+	}
+}
+
+func TestProxyRoutesFetches(t *testing.T) {
+	var target, auth string
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Forward proxy gets the absolute url
+		target = r.URL.String()
+		auth = r.Header.Get("Proxy-Authorization")
+		w.Write([]byte("from proxy"))
+	}))
+	defer proxy.Close()
+
+	proxyUrl := "http://user:secret@" + strings.TrimPrefix(proxy.URL, "http://")
+	transport, err := newTransport(Config{Proxy: proxyUrl})
+	if err != nil {
+		t.Fatalf("newTransport: %v", err)
+	}
+	defer transport.CloseIdleConnections()
+
+	// Host that doesn't resolve, only the proxy can answer
+	url := "http://downstream.invalid/page"
+	result, err := downloadUrl(context.Background(), &http.Client{Transport: transport}, url, testOptions())
+	if err != nil {
+		t.Fatalf("downloadUrl: %v", err)
+	}
+
+	if result.Result != "from proxy" {
+		t.Errorf("Result = %q, want response of the proxy", result.Result)
+	}
+	if target != url {
+		t.Errorf("proxy got request for %q, want %q", target, url)
+	}
+	if want := "Basic " + base64.StdEncoding.EncodeToString([]byte("user:secret")); auth != want {
+		t.Errorf("Proxy-Authorization = %q, want %q", auth, want)
+	}
+}
+
+func TestValidateRequestConflicts(t *testing.T) {
+	tests := []struct {
+		name    string
+		body    string
+		format  string
+		wantErr string
+	}{
+		{name: "valid batch", body: `{"urls":["http://a/"]}`},
+		{name: "valid stream", body: `{"urls":["http://a/"],"progress":true,"max_results":1}`, format: StreamNdjson},
+		{name: "status_only grep", body: `{"urls":["http://a/"],"status_only":true,"grep":"x"}`, wantErr: "grep conflicts with status_only"},
+		{name: "status_only encoding", body: `{"urls":["http://a/"],"status_only":true,"encoding":"hex"}`, wantErr: "encoding conflicts with status_only"},
+		{name: "status_only min_body_bytes", body: `{"urls":["http://a/"],"status_only":true,"min_body_bytes":1}`, wantErr: "min_body_bytes conflicts with status_only"},
+		{name: "status_only extract_metadata", body: `{"urls":["http://a/"],"status_only":true,"extract_metadata":true}`, wantErr: "extract_metadata conflicts with status_only"},
+		{name: "status_only partial_on_timeout", body: `{"urls":["http://a/"],"status_only":true,"partial_on_timeout":true}`, wantErr: "partial_on_timeout conflicts with status_only"},
+		{name: "status_only dedup", body: `{"urls":["http://a/"],"status_only":true,"dedup":true}`, wantErr: "dedup conflicts with status_only"},
+		{name: "status_only result field", body: `{"urls":["http://a/"],"status_only":true,"fields":["url","result"]}`, wantErr: "result field conflicts with status_only"},
+		{name: "preserve_encoding grep", body: `{"urls":["http://a/"],"preserve_encoding":true,"grep":"x"}`, wantErr: "grep conflicts with preserve_encoding"},
+		{name: "preserve_encoding extract_metadata", body: `{"urls":["http://a/"],"preserve_encoding":true,"extract_metadata":true}`, wantErr: "extract_metadata conflicts with preserve_encoding"},
+		{name: "parallel_chunks several urls", body: `{"urls":["http://a/","http://b/"],"parallel_chunks":true}`, wantErr: "parallel_chunks requires exactly one url"},
+		{name: "parallel_chunks status_only", body: `{"urls":["http://a/"],"parallel_chunks":true,"status_only":true}`, wantErr: "parallel_chunks conflicts with status_only"},
+		{name: "zip status_only", body: `{"urls":["http://a/"],"status_only":true}`, format: StreamZip, wantErr: "status_only conflicts with zip response"},
+		{name: "zip fields", body: `{"urls":["http://a/"],"fields":["url"]}`, format: StreamZip, wantErr: "fields conflicts with zip response"},
+		{name: "csv fields", body: `{"urls":["http://a/"],"fields":["url"]}`, format: StreamCsv, wantErr: "fields conflicts with csv response"},
+		{name: "stream store_result", body: `{"urls":["http://a/"],"store_result":true}`, format: StreamNdjson, wantErr: "store_result requires a batch response"},
+		{name: "stream dedup", body: `{"urls":["http://a/"],"dedup":true}`, format: StreamArray, wantErr: "dedup requires a batch response"},
+		{name: "stream min_success_ratio", body: `{"urls":["http://a/"],"min_success_ratio":0.5}`, format: StreamNdjson, wantErr: "min_success_ratio and min_success_count require a batch response"},
+		{name: "batch progress", body: `{"urls":["http://a/"],"progress":true}`, wantErr: "progress requires streaming"},
+		{name: "zip progress", body: `{"urls":["http://a/"],"progress":true}`, format: StreamZip, wantErr: "progress conflicts with zip response"},
+		{name: "csv progress", body: `{"urls":["http://a/"],"progress":true}`, format: StreamCsv, wantErr: "progress conflicts with csv response"},
+		{name: "batch max_results", body: `{"urls":["http://a/"],"max_results":1}`, wantErr: "max_results requires streaming"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			request, err := readRequest(strings.NewReader(test.body))
+			if err != nil {
+				t.Fatalf("readRequest: %v", err)
+			}
+
+			err = validateRequest(request, test.format)
+			if test.wantErr == "" {
+				if err != nil {
+					t.Errorf("validateRequest: %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+				t.Errorf("validateRequest error = %v, want %q", err, test.wantErr)
+			}
+		})
+	}
+}
+
+func TestWorkerCount(t *testing.T) {
+	tests := []struct {
+		tasks, want int
+	}{
+		{tasks: 0, want: 0},
+		{tasks: 1, want: 1},
+		{tasks: MaxConcurrentTasksPerRequest - 1, want: MaxConcurrentTasksPerRequest - 1},
+		{tasks: MaxConcurrentTasksPerRequest, want: MaxConcurrentTasksPerRequest},
+		{tasks: MaxConcurrentTasksPerRequest * 10, want: MaxConcurrentTasksPerRequest},
+	}
+
+	for _, test := range tests {
+		if got := workerCount(test.tasks); got != test.want {
+			t.Errorf("workerCount(%d) = %d, want %d", test.tasks, got, test.want)
+		}
+	}
+}
+
+func TestDownloadUrlsStartsNoMoreWorkersThanUrls(t *testing.T) {
+	server, _ := newCountingServer(t, "ok")
+
+	var started int32
+	defer func(start func(func())) { startWorker = start }(startWorker)
+	startWorker = func(worker func()) {
+		atomic.AddInt32(&started, 1)
+		go worker()
+	}
+
+	urls := []UrlEntry{{Url: server.URL + "/a"}, {Url: server.URL + "/b"}}
+	if _, err := downloadUrls(context.Background(), server.Client(), urls, testOptions()); err != nil {
+		t.Fatalf("downloadUrls: %v", err)
+	}
+
+	if got := atomic.LoadInt32(&started); got != int32(len(urls)) {
+		t.Errorf("downloadUrls started %d workers for %d urls", got, len(urls))
+	}
+}
+
+func TestDNSFailureIsPlatformIndependent(t *testing.T) {
+	// .invalid never resolves
+	host := "no-such-host.invalid"
+	_, err := downloadUrl(context.Background(), http.DefaultClient, "http://"+host+"/", testOptions())
+
+	var dnsErr *DNSError
+	if !errors.As(err, &dnsErr) {
+		t.Fatalf("error = %v, want DNSError", err)
+	}
+	if dnsErr.Host != host {
+		t.Errorf("Host = %q, want %q", dnsErr.Host, host)
+	}
+	if want := "dns resolution failed for host " + host; err.Error() != want {
+		t.Errorf("error = %q, want %q", err.Error(), want)
+	}
+	if kind := errorKind(err); kind != ErrorKindDNS {
+		t.Errorf("errorKind = %q, want %s", kind, ErrorKindDNS)
+	}
+}
+
+func TestByPriority(t *testing.T) {
+	urls := []UrlEntry{
+		{Url: "low"},
+		{Url: "high", Priority: 2},
+		{Url: "low-2"},
+		{Url: "middle", Priority: 1},
+		{Url: "high-2", Priority: 2},
+		{Url: "negative", Priority: -1},
+	}
+	want := []string{"high", "high-2", "middle", "low", "low-2", "negative"}
+
+	sorted := byPriority(urls)
+	for i, entry := range sorted {
+		if entry.Url != want[i] {
+			t.Fatalf("order = %v, want %v", sorted, want)
+		}
+	}
+	if urls[0].Url != "low" {
+		t.Errorf("byPriority reordered its argument")
+	}
+}
+
+func TestPriorityUrlsCompleteBeforeDeadline(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(300 * time.Millisecond)
+		w.Write([]byte(r.URL.Path))
+	}))
+	defer server.Close()
+
+	// Low priority urls come first, a FIFO would fetch only them in time
+	var urls []UrlEntry
+	for i := 0; i < MaxConcurrentTasksPerRequest; i++ {
+		urls = append(urls, UrlEntry{Url: fmt.Sprintf("%s/low-%d", server.URL, i)})
+	}
+	for i := 0; i < MaxConcurrentTasksPerRequest; i++ {
+		urls = append(urls, UrlEntry{Url: fmt.Sprintf("%s/high-%d", server.URL, i), Priority: 1})
+	}
+
+	// Time for one round of fetches only
+	ctx, cancel := context.WithTimeout(context.Background(), 450*time.Millisecond)
+	defer cancel()
+	results, err := downloadUrls(ctx, server.Client(), urls, testOptions())
+	if err == nil {
+		t.Fatalf("downloadUrls completed all urls before the deadline")
+	}
+
+	if len(results) != MaxConcurrentTasksPerRequest {
+		t.Fatalf("got %d results, want %d", len(results), MaxConcurrentTasksPerRequest)
+	}
+	for _, result := range results {
+		if !strings.Contains(result.Url, "/high-") || result.Err != nil {
+			t.Errorf("completed %s (error %v), want only high priority urls", result.Url, result.Err)
+		}
+	}
+}
+
+func TestReadBodyLimit(t *testing.T) {
+	body := strings.Repeat("x", 100)
+	tests := []struct {
+		name          string
+		maxBytes      int64
+		sizeHint      int64
+		wantLen       int
+		wantTruncated bool
+	}{
+		{name: "under limit", maxBytes: 200, wantLen: 100},
+		{name: "at limit", maxBytes: 100, wantLen: 100},
+		{name: "over limit", maxBytes: 99, wantLen: 99, wantTruncated: true},
+		{name: "exact hint", maxBytes: 200, sizeHint: 100, wantLen: 100},
+		{name: "hint over limit", maxBytes: 50, sizeHint: 100, wantLen: 50, wantTruncated: true},
+		{name: "hint under body", maxBytes: 200, sizeHint: 10, wantLen: 100},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			data, truncated, err := readBody(strings.NewReader(body), test.maxBytes, test.sizeHint)
+			if err != nil {
+				t.Fatalf("readBody: %v", err)
+			}
+			if len(data) != test.wantLen || truncated != test.wantTruncated {
+				t.Errorf("got %d bytes, truncated %t, want %d bytes, truncated %t", len(data), truncated, test.wantLen, test.wantTruncated)
+			}
+		})
+	}
+}
+
+func TestBodySizeHint(t *testing.T) {
+	tests := []struct {
+		name           string
+		contentLength  int64
+		readBufferSize int64
+		want           int64
+	}{
+		{name: "unknown length", contentLength: -1, readBufferSize: 32 << 10, want: 32 << 10},
+		{name: "small body", contentLength: 1000, readBufferSize: 32 << 10, want: 1000},
+		{name: "large body", contentLength: MaxBodyBytesPerUrl, readBufferSize: 32 << 10, want: MaxPresizeBytes},
+		{name: "large body, larger buffer", contentLength: MaxBodyBytesPerUrl, readBufferSize: 4 << 20, want: 4 << 20},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := bodySizeHint(test.contentLength, test.readBufferSize); got != test.want {
+				t.Errorf("bodySizeHint(%d, %d) = %d, want %d", test.contentLength, test.readBufferSize, got, test.want)
+			}
+		})
+	}
+}
+
+// Compares growing the buffer as ioutil.ReadAll does with pre-sizing it from
+// Content-Length. Run with -benchmem to see allocations.
+func BenchmarkReadBody(b *testing.B) {
+	for _, size := range []int{4 << 10, 1 << 20, 8 << 20} {
+		body := bytes.Repeat([]byte("x"), size)
+
+		b.Run(fmt.Sprintf("ReadAll/%dKB", size>>10), func(b *testing.B) {
+			b.SetBytes(int64(size))
+			for i := 0; i < b.N; i++ {
+				ioutil.ReadAll(io.LimitReader(bytes.NewReader(body), MaxBodyBytesPerUrl+1))
+			}
+		})
+
+		b.Run(fmt.Sprintf("PreSized/%dKB", size>>10), func(b *testing.B) {
+			b.SetBytes(int64(size))
+			for i := 0; i < b.N; i++ {
+				readBody(bytes.NewReader(body), MaxBodyBytesPerUrl, int64(size))
+			}
+		})
+	}
+}
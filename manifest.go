@@ -0,0 +1,113 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	neturl "net/url"
+)
+
+const MaxManifestBytes = 1 << 20
+
+// Manifest could not be fetched or parsed, Result tells how its fetch went
+type ManifestError struct {
+	Result TaskResult
+	Err    error
+}
+
+func (e *ManifestError) Error() string {
+	return fmt.Sprintf("failed to load manifest \"%s\": %s", e.Result.Url, e.Err)
+}
+
+// Url entries from JSON array or NDJSON, one entry (string or object) per line
+func parseManifest(data []byte) ([]UrlEntry, error) {
+	data = bytes.TrimSpace(data)
+	if len(data) > 0 && data[0] == '[' {
+		var urls []UrlEntry
+		if err := json.Unmarshal(data, &urls); err != nil {
+			return nil, err
+		}
+		return urls, nil
+	}
+
+	var urls []UrlEntry
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for line := 1; scanner.Scan(); line++ {
+		if len(bytes.TrimSpace(scanner.Bytes())) == 0 {
+			continue
+		}
+
+		var entry UrlEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			return nil, fmt.Errorf("invalid url at line %d: %s", line, err)
+		}
+		urls = append(urls, entry)
+	}
+
+	return urls, scanner.Err()
+}
+
+// Downloads manifest with the options of the request and returns its urls,
+// relative ones resolved against the manifest url. Number of urls is checked
+// by the caller like for urls given in the request.
+func (h *Handler) loadManifest(ctx context.Context, url string, opts DownloadOptions) ([]UrlEntry, error) {
+	opts.MaxBodyBytes = MaxManifestBytes
+	opts.MinBodyBytes = 0
+	opts.Grep = nil
+	opts.StatusOnly = false
+	opts.KeepFailed = false
+	opts.Encoding = EncodingAuto
+	opts.PreserveEncoding = false
+	opts.PartialOnTimeout = false
+	opts.RangeChunks = false
+	opts.ExtractMetadata = false
+
+	retryBudget := int32(opts.RetryBudget)
+	result := downloadWithRetries(ctx, h.clientFor(opts), UrlEntry{Url: url}, opts, &retryBudget)
+	urls, err := manifestUrls(result)
+	if err != nil {
+		// Only how the fetch went is reported, along with parse errors
+		result.Result = ""
+		if result.Err == nil {
+			result.Err = err
+			result.Error = err.Error()
+		}
+		return nil, &ManifestError{Result: result, Err: err}
+	}
+
+	return urls, nil
+}
+
+func manifestUrls(result TaskResult) ([]UrlEntry, error) {
+	if result.Err != nil {
+		return nil, result.Err
+	}
+
+	if result.Truncated {
+		return nil, fmt.Errorf("manifest exceeds %d bytes", MaxManifestBytes)
+	}
+
+	data, err := decodeBody(result)
+	if err != nil {
+		return nil, err
+	}
+
+	urls, err := parseManifest(data)
+	if err != nil {
+		return nil, err
+	}
+
+	base, err := neturl.Parse(result.Url)
+	if err != nil {
+		return nil, err
+	}
+	for i := range urls {
+		if err := urls[i].resolve(base); err != nil {
+			return nil, err
+		}
+	}
+
+	return urls, nil
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"encoding/xml"
+	"mime"
+	"strings"
+)
+
+// Link preview data of an HTML page
+type PageMetadata struct {
+	Title       string `json:"title,omitempty"`
+	Description string `json:"description,omitempty"`
+}
+
+func isHTML(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	return err == nil && (mediaType == "text/html" || mediaType == "application/xhtml+xml")
+}
+
+// Lowercases ASCII letters only, so byte offsets stay the same
+func asciiLower(s string) string {
+	lower := []byte(s)
+	for i, c := range lower {
+		if 'A' <= c && c <= 'Z' {
+			lower[i] = c + ('a' - 'A')
+		}
+	}
+
+	return string(lower)
+}
+
+// Cuts page after the head and removes script and style elements, their
+// content is not markup and would break the tokenizer
+func htmlHead(page string) string {
+	lower := asciiLower(page)
+	if end := strings.Index(lower, "</head"); end >= 0 {
+		page, lower = page[:end], lower[:end]
+	}
+
+	var head strings.Builder
+	for {
+		start := strings.Index(lower, "<script")
+		if style := strings.Index(lower, "<style"); style >= 0 && (start < 0 || style < start) {
+			start = style
+		}
+		if start < 0 {
+			break
+		}
+
+		closing := "</script"
+		if strings.HasPrefix(lower[start:], "<style") {
+			closing = "</style"
+		}
+
+		head.WriteString(page[:start])
+		end := strings.Index(lower[start:], closing)
+		if end < 0 {
+			return head.String()
+		}
+
+		end += start + len(closing)
+		if gt := strings.IndexByte(lower[end:], '>'); gt >= 0 {
+			end += gt + 1
+		}
+		page, lower = page[end:], lower[end:]
+	}
+	head.WriteString(page)
+
+	return head.String()
+}
+
+// Extracts title and meta description from the head of an HTML page. Non-strict
+// xml tokenizer copes with most real world HTML, parsing stops at the end of
+// head or at the first error, whatever was found by then is returned.
+func extractMetadata(page string) *PageMetadata {
+	decoder := xml.NewDecoder(strings.NewReader(htmlHead(page)))
+	decoder.Strict = false
+	decoder.AutoClose = xml.HTMLAutoClose
+	decoder.Entity = xml.HTMLEntity
+
+	var metadata PageMetadata
+	inTitle := false
+	for {
+		token, err := decoder.Token()
+		if err != nil {
+			break
+		}
+
+		switch t := token.(type) {
+		case xml.StartElement:
+			switch strings.ToLower(t.Name.Local) {
+			case "title":
+				inTitle = metadata.Title == ""
+			case "meta":
+				if description, ok := metaDescription(t.Attr); ok && metadata.Description == "" {
+					metadata.Description = description
+				}
+			case "body":
+				return metadata.orNil()
+			}
+
+		case xml.EndElement:
+			switch strings.ToLower(t.Name.Local) {
+			case "title":
+				inTitle = false
+				metadata.Title = strings.TrimSpace(metadata.Title)
+			case "head":
+				return metadata.orNil()
+			}
+
+		case xml.CharData:
+			if inTitle {
+				metadata.Title += string(t)
+			}
+		}
+	}
+
+	metadata.Title = strings.TrimSpace(metadata.Title)
+	return metadata.orNil()
+}
+
+func metaDescription(attrs []xml.Attr) (string, bool) {
+	var name, content string
+	for _, attr := range attrs {
+		switch strings.ToLower(attr.Name.Local) {
+		case "name":
+			name = attr.Value
+		case "content":
+			content = attr.Value
+		}
+	}
+
+	return strings.TrimSpace(content), strings.EqualFold(name, "description")
+}
+
+func (m *PageMetadata) orNil() *PageMetadata {
+	if m.Title == "" && m.Description == "" {
+		return nil
+	}
+
+	return m
+}
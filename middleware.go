@@ -0,0 +1,206 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"runtime/debug"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type Middleware func(http.Handler) http.Handler
+
+// Wraps handler with middlewares, the first one is the outermost
+func chain(handler http.Handler, middlewares ...Middleware) http.Handler {
+	for i := len(middlewares) - 1; i >= 0; i-- {
+		handler = middlewares[i](handler)
+	}
+
+	return handler
+}
+
+// Remembers response status for middlewares running after the handler
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	if r.status == 0 {
+		r.status = status
+	}
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *statusRecorder) Write(data []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	return r.ResponseWriter.Write(data)
+}
+
+// Handler that wrote nothing responds with 200
+func (r *statusRecorder) Status() int {
+	if r.status == 0 {
+		return http.StatusOK
+	}
+	return r.status
+}
+
+// Lets http.ResponseController reach Flush and friends of the wrapped writer
+func (r *statusRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
+
+func newStatusRecorder(w http.ResponseWriter) *statusRecorder {
+	if recorder, ok := w.(*statusRecorder); ok {
+		return recorder
+	}
+
+	return &statusRecorder{ResponseWriter: w}
+}
+
+// Marks responses of clients asking for indented json, see jsonResponse
+type prettyWriter struct {
+	http.ResponseWriter
+}
+
+func (p *prettyWriter) Unwrap() http.ResponseWriter {
+	return p.ResponseWriter
+}
+
+// Looks for prettyWriter under the writers wrapping it
+func isPretty(w http.ResponseWriter) bool {
+	for {
+		switch writer := w.(type) {
+		case *prettyWriter:
+			return true
+		case interface{ Unwrap() http.ResponseWriter }:
+			w = writer.Unwrap()
+		default:
+			return false
+		}
+	}
+}
+
+// Enables indented json for ?pretty=1 or X-Pretty header
+func prettyMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("pretty") == "1" || r.Header.Get("X-Pretty") != "" {
+			w = &prettyWriter{w}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Logs requests with client address resolved behind trusted proxies
+func loggingMiddleware(proxies TrustedProxies) Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			started := time.Now()
+			info := &RequestInfo{ID: requestID(r), ClientIP: proxies.ClientIP(r), Started: started}
+			w.Header().Set("X-Request-Id", info.ID)
+			recorder := newStatusRecorder(w)
+			next.ServeHTTP(recorder, withRequestInfo(r, info))
+
+			log.Printf("%s %s %s %d %s request_bytes=%d concurrency=%d id=%s", info.ClientIP, r.Method, r.URL.Path,
+				recorder.Status(), time.Since(started), info.BodyBytes(), info.Concurrency(), info.ID)
+		})
+	}
+}
+
+// Responds with 500 unless the handler already started the response
+func respondInternalError(recorder *statusRecorder) {
+	if recorder.status != 0 {
+		return
+	}
+
+	if err := errorResponse(recorder, 500, ErrorInternal, "Internal server error"); err != nil {
+		log.Printf("Failed to respond with internal error: %s", err)
+	}
+}
+
+// Converts a panic into 500 response instead of dropping the connection
+func recoveryMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		recorder := newStatusRecorder(w)
+		defer func() {
+			err := recover()
+			if err == nil {
+				return
+			}
+
+			if err == http.ErrAbortHandler {
+				panic(err)
+			}
+
+			log.Printf("Panic while serving %s %s: %v\n%s", r.Method, r.URL.Path, err, debug.Stack())
+			respondInternalError(recorder)
+		}()
+
+		next.ServeHTTP(recorder, r)
+	})
+}
+
+// Adapts handler returning an error, the error is answered with 500
+func handleErrors(handler func(http.ResponseWriter, *http.Request) error) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		recorder := newStatusRecorder(w)
+		if err := handler(recorder, r); err != nil {
+			log.Printf("Failed to serve %s %s: %s", r.Method, r.URL.Path, err)
+			respondInternalError(recorder)
+		}
+	})
+}
+
+type Metrics struct {
+	requests   int64
+	inFlight   int64
+	durationNs int64
+
+	mu       sync.Mutex
+	statuses map[int]int64
+}
+
+func newMetrics() *Metrics {
+	return &Metrics{statuses: make(map[int]int64)}
+}
+
+func (m *Metrics) Snapshot() map[string]interface{} {
+	m.mu.Lock()
+	statuses := make(map[int]int64, len(m.statuses))
+	for status, count := range m.statuses {
+		statuses[status] = count
+	}
+	m.mu.Unlock()
+
+	return map[string]interface{}{
+		"requests":          atomic.LoadInt64(&m.requests),
+		"in_flight":         atomic.LoadInt64(&m.inFlight),
+		"total_duration_ms": atomic.LoadInt64(&m.durationNs) / int64(time.Millisecond),
+		"statuses":          statuses,
+	}
+}
+
+func metricsMiddleware(m *Metrics) Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			started := time.Now()
+			atomic.AddInt64(&m.requests, 1)
+			atomic.AddInt64(&m.inFlight, 1)
+
+			recorder := newStatusRecorder(w)
+			defer func() {
+				atomic.AddInt64(&m.inFlight, -1)
+				atomic.AddInt64(&m.durationNs, int64(time.Since(started)))
+
+				m.mu.Lock()
+				m.statuses[recorder.Status()]++
+				m.mu.Unlock()
+			}()
+
+			next.ServeHTTP(recorder, r)
+		})
+	}
+}
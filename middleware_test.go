@@ -0,0 +1,49 @@
+package main
+
+import (
+	"encoding/json"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestInternalErrorResponses(t *testing.T) {
+	tests := []struct {
+		name    string
+		handler http.Handler
+	}{
+		{
+			name: "marshal failure",
+			handler: handleErrors(func(w http.ResponseWriter, r *http.Request) error {
+				// json has no infinity
+				return jsonResponse(w, 200, map[string]interface{}{"value": math.Inf(1)})
+			}),
+		},
+		{
+			name: "panic",
+			handler: recoveryMiddleware(handleErrors(func(w http.ResponseWriter, r *http.Request) error {
+				panic("bad request")
+			})),
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			test.handler.ServeHTTP(w, httptest.NewRequest("POST", "/", nil))
+
+			if w.Code != 500 {
+				t.Fatalf("status = %d, want 500", w.Code)
+			}
+
+			var body map[string]interface{}
+			if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+				t.Fatalf("body %q is not json: %v", w.Body.String(), err)
+			}
+			if body["error_code"] != string(ErrorInternal) {
+				t.Errorf("error_code = %v, want %s", body["error_code"], ErrorInternal)
+			}
+		})
+	}
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	neturl "net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// Token is refreshed this long before it expires
+	TokenExpiryMargin = 30 * time.Second
+	// Lifetime of tokens issued without expires_in
+	DefaultTokenLifetime = 5 * time.Minute
+	TokenFetchTimeout    = 10 * time.Second
+)
+
+// Bearer token obtained by OAuth client-credentials flow, attached to
+// fetches of configured hosts
+type TokenSource struct {
+	tokenUrl     string
+	clientId     string
+	clientSecret string
+	scope        string
+	hosts        map[string]bool
+	client       *http.Client
+
+	mu      sync.Mutex
+	token   string
+	expires time.Time
+	// Concurrent refreshes share a single token request
+	refresh flightGroup
+}
+
+func newTokenSource(config Config, client *http.Client) *TokenSource {
+	t := &TokenSource{
+		tokenUrl:     config.OAuthTokenUrl,
+		clientId:     config.OAuthClientId,
+		clientSecret: config.OAuthClientSecret,
+		scope:        config.OAuthScope,
+		hosts:        make(map[string]bool),
+		client:       client,
+	}
+	for _, host := range strings.Split(config.OAuthHosts, ",") {
+		if host = strings.TrimSpace(host); host != "" {
+			t.hosts[strings.ToLower(host)] = true
+		}
+	}
+
+	return t
+}
+
+func (t *TokenSource) Matches(host string) bool {
+	return t.hosts[strings.ToLower(host)]
+}
+
+// Returns cached token, refreshing it when it is about to expire
+func (t *TokenSource) Token() (string, error) {
+	t.mu.Lock()
+	token, expires := t.token, t.expires
+	t.mu.Unlock()
+
+	if token != "" && time.Until(expires) > TokenExpiryMargin {
+		return token, nil
+	}
+
+	val, _, err := t.refresh.Do("token", func() (interface{}, error) {
+		// Shared by all waiting fetches, so not bound to any of them
+		ctx, cancel := context.WithTimeout(context.Background(), TokenFetchTimeout)
+		defer cancel()
+
+		token, lifetime, err := t.fetch(ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		t.mu.Lock()
+		t.token, t.expires = token, time.Now().Add(lifetime)
+		t.mu.Unlock()
+		return token, nil
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to obtain auth token: %w", err)
+	}
+
+	return val.(string), nil
+}
+
+func (t *TokenSource) fetch(ctx context.Context) (string, time.Duration, error) {
+	form := neturl.Values{"grant_type": {"client_credentials"}}
+	if t.scope != "" {
+		form.Set("scope", t.scope)
+	}
+
+	request, err := http.NewRequestWithContext(ctx, "POST", t.tokenUrl, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", 0, err
+	}
+
+	request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	request.SetBasicAuth(neturl.QueryEscape(t.clientId), neturl.QueryEscape(t.clientSecret))
+
+	resp, err := t.client.Do(request)
+	if err != nil {
+		return "", 0, err
+	}
+	defer resp.Body.Close()
+
+	data, _, err := readBody(resp.Body, MaxBodyBytesPerUrl, 0)
+	if err != nil {
+		return "", 0, err
+	}
+
+	if !(resp.StatusCode >= 200 && resp.StatusCode < 300) {
+		return "", 0, fmt.Errorf("status code: %d (%s)", resp.StatusCode, string(data))
+	}
+
+	var token struct {
+		AccessToken string `json:"access_token"`
+		TokenType   string `json:"token_type"`
+		ExpiresIn   int64  `json:"expires_in"`
+	}
+	if err := json.Unmarshal(data, &token); err != nil {
+		return "", 0, err
+	}
+
+	if token.AccessToken == "" {
+		return "", 0, fmt.Errorf("no access_token in response")
+	}
+
+	if token.TokenType != "" && !strings.EqualFold(token.TokenType, "bearer") {
+		return "", 0, fmt.Errorf("unsupported token type \"%s\"", token.TokenType)
+	}
+
+	lifetime := DefaultTokenLifetime
+	if token.ExpiresIn > 0 {
+		lifetime = time.Duration(token.ExpiresIn) * time.Second
+	}
+
+	return token.AccessToken, lifetime, nil
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"io"
+	"time"
+)
+
+const (
+	// Progress of a url is reported at most this often
+	ProgressInterval = 500 * time.Millisecond
+	// Progress events waiting for the stream, later ones are dropped
+	ProgressQueueSize = 100
+)
+
+// Bytes of url body read so far, written to streams between results
+type ProgressEvent struct {
+	Event string `json:"event"`
+	Url   string `json:"url"`
+	Bytes int64  `json:"bytes"`
+	// Content-Length, percent is left out when downstream didn't send it
+	TotalBytes int64 `json:"total_bytes,omitempty"`
+	Percent    *int  `json:"percent,omitempty"`
+}
+
+// Collects progress of request urls for the stream. Reporting never blocks
+// downloads: events are dropped while the stream is busy, the next one
+// carries the newer count anyway.
+type ProgressReporter struct {
+	events chan ProgressEvent
+}
+
+func newProgressReporter() *ProgressReporter {
+	return &ProgressReporter{events: make(chan ProgressEvent, ProgressQueueSize)}
+}
+
+func (p *ProgressReporter) Events() <-chan ProgressEvent {
+	return p.events
+}
+
+func (p *ProgressReporter) report(url string, read, total int64) {
+	event := ProgressEvent{Event: "progress", Url: url, Bytes: read}
+	if total > 0 {
+		percent := int(read * 100 / total)
+		event.TotalBytes = total
+		event.Percent = &percent
+	}
+
+	select {
+	case p.events <- event:
+	default:
+	}
+}
+
+// Reports bytes read from body every ProgressInterval, total is -1 if unknown
+type progressReader struct {
+	io.Reader
+	reporter *ProgressReporter
+	url      string
+	total    int64
+	read     int64
+	reported time.Time
+}
+
+func newProgressReader(r io.Reader, reporter *ProgressReporter, url string, total int64) *progressReader {
+	return &progressReader{Reader: r, reporter: reporter, url: url, total: total, reported: time.Now()}
+}
+
+func (r *progressReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	r.read += int64(n)
+
+	if now := time.Now(); n > 0 && now.Sub(r.reported) >= ProgressInterval {
+		r.reported = now
+		r.reporter.report(r.url, r.read, r.total)
+	}
+
+	return n, err
+}
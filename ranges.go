@@ -0,0 +1,166 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// Smaller bodies are not worth extra requests
+const MinRangeChunkBytes = 64 << 10
+
+// Returns HEAD response when downstream serves byte ranges of the url
+func probeRanges(ctx context.Context, client *http.Client, request *http.Request) (*http.Response, bool) {
+	probe, err := http.NewRequestWithContext(ctx, "HEAD", request.URL.String(), nil)
+	if err != nil {
+		return nil, false
+	}
+
+	probe.Header = request.Header.Clone()
+	resp, err := client.Do(probe)
+	if err != nil {
+		return nil, false
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Encoding") != "" {
+		return nil, false
+	}
+
+	if !strings.EqualFold(resp.Header.Get("Accept-Ranges"), "bytes") || resp.ContentLength <= 0 {
+		return nil, false
+	}
+
+	return resp, true
+}
+
+// Downloads body of request in parallel byte ranges, falls back to a single
+// GET when downstream doesn't support ranges or the body is small
+func doRangeFetch(ctx context.Context, client *http.Client, request *http.Request, opts DownloadOptions) (*TaskResult, error) {
+	// Request context may carry more than ctx, e.g. redirect policy
+	ctx, cancel := context.WithCancel(request.Context())
+	defer cancel()
+
+	// Probe and the single GET instead of ranges share one host slot
+	release, err := acquireHostSlot(ctx, opts.HostSlots, request.URL.Host)
+	if err != nil {
+		return nil, err
+	}
+
+	probe, ok := probeRanges(ctx, client, request)
+	if !ok || probe.ContentLength < 2*MinRangeChunkBytes {
+		defer release()
+		return doFetch(ctx, client, request, opts)
+	}
+	release()
+
+	length := probe.ContentLength
+	size, truncated := length, false
+	if size > opts.MaxBodyBytes {
+		size, truncated = opts.MaxBodyBytes, true
+	}
+
+	chunks := int64(MaxConcurrentTasksPerRequest)
+	if slots := opts.SchemeSlots[request.URL.Scheme]; slots != nil {
+		chunks = int64(cap(slots))
+	}
+	chunkSize := (size + chunks - 1) / chunks
+	if chunkSize < MinRangeChunkBytes {
+		chunkSize = MinRangeChunkBytes
+	}
+
+	body := make([]byte, size)
+	var mu sync.Mutex
+	var firstErr error
+	var proto string
+	var wg sync.WaitGroup
+	for start := int64(0); start < size; start += chunkSize {
+		end := start + chunkSize
+		if end > size {
+			end = size
+		}
+
+		wg.Add(1)
+		go func(start int64, chunk []byte) {
+			defer wg.Done()
+			chunkProto, err := fetchRange(ctx, client, request, opts, start, length, chunk)
+
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil && firstErr == nil {
+				firstErr = err
+				cancel()
+			}
+			proto = chunkProto
+		}(start, body[start:end])
+	}
+	wg.Wait()
+
+	if firstErr != nil {
+		return nil, firstErr
+	}
+
+	return &TaskResult{
+		StatusCode: http.StatusOK,
+		Proto:      proto,
+		Result:     string(body),
+		Truncated:  truncated,
+		Headers:    probe.Header,
+	}, nil
+}
+
+// Fills chunk with body bytes starting at offset, total is the expected
+// length of the whole body
+func fetchRange(ctx context.Context, client *http.Client, request *http.Request, opts DownloadOptions, offset, total int64, chunk []byte) (string, error) {
+	if slots := opts.SchemeSlots[request.URL.Scheme]; slots != nil {
+		select {
+		case slots <- struct{}{}:
+			defer func() { <-slots }()
+		case <-ctx.Done():
+			return "", ctx.Err()
+		}
+	}
+
+	release, err := acquireHostSlot(ctx, opts.HostSlots, request.URL.Host)
+	if err != nil {
+		return "", err
+	}
+	defer release()
+
+	if opts.StartGate != nil {
+		if err := opts.StartGate.Wait(ctx); err != nil {
+			return "", err
+		}
+	}
+
+	rangeRequest := request.Clone(ctx)
+	rangeRequest.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", offset, offset+int64(len(chunk))-1))
+	resp, err := client.Do(rangeRequest)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusPartialContent {
+		return "", fmt.Errorf("range request: status code: %d", resp.StatusCode)
+	}
+
+	// Body changed since the probe if its length differs
+	var start, end, length int64
+	if _, err := fmt.Sscanf(resp.Header.Get("Content-Range"), "bytes %d-%d/%d", &start, &end, &length); err != nil {
+		return "", fmt.Errorf("range request: invalid Content-Range \"%s\"", resp.Header.Get("Content-Range"))
+	}
+
+	if start != offset || end != offset+int64(len(chunk))-1 || length != total {
+		return "", fmt.Errorf("range request: unexpected Content-Range \"%s\"", resp.Header.Get("Content-Range"))
+	}
+
+	if _, err := io.ReadFull(resp.Body, chunk); err != nil {
+		return "", fmt.Errorf("range request: %w", err)
+	}
+
+	return resp.Proto, nil
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestRangeChunksKeepHostLimit(t *testing.T) {
+	content := bytes.Repeat([]byte("x"), 8*MinRangeChunkBytes)
+	var inFlight, maxInFlight int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := atomic.AddInt32(&inFlight, 1)
+		defer atomic.AddInt32(&inFlight, -1)
+		for {
+			max := atomic.LoadInt32(&maxInFlight)
+			if n <= max || atomic.CompareAndSwapInt32(&maxInFlight, max, n) {
+				break
+			}
+		}
+
+		time.Sleep(20 * time.Millisecond)
+		http.ServeContent(w, r, "body", time.Time{}, bytes.NewReader(content))
+	}))
+	defer server.Close()
+
+	opts := testOptions()
+	opts.RangeChunks = true
+	opts.HostSlots = newHostSlots(2)
+	opts.SchemeSlots = map[string]chan struct{}{"http": make(chan struct{}, 8)}
+
+	result, err := downloadUrl(context.Background(), server.Client(), server.URL, opts)
+	if err != nil {
+		t.Fatalf("downloadUrl: %v", err)
+	}
+	if result.Result != string(content) {
+		t.Fatalf("body of %d bytes differs from the served one", len(result.Result))
+	}
+
+	if got := atomic.LoadInt32(&maxInFlight); got > 2 {
+		t.Errorf("downstream got %d requests at once, want at most 2", got)
+	}
+}
@@ -0,0 +1,386 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultResultsPageSize = 100
+	MaxResultsPageSize     = 1000
+)
+
+// Response of a request kept for GET /results/{id}
+type StoredResult struct {
+	// Only the tenant of the request may read it
+	Tenant  string          `json:"tenant"`
+	Status  int             `json:"status"`
+	Expires time.Time       `json:"expires"`
+	Body    json.RawMessage `json:"body"`
+	// Urls in the order of the request, results are paged in it
+	Urls []string `json:"urls,omitempty"`
+	// Hash of the request body, set for idempotent requests
+	Fingerprint string `json:"fingerprint,omitempty"`
+}
+
+// Responses of requests with store_result by tenantScopedId of request id.
+// Get reports false for unknown and expired ids.
+type ResultStore interface {
+	Put(id string, result StoredResult) error
+	Get(id string) (StoredResult, bool, error)
+	// Removes expired results
+	Cleanup() error
+}
+
+func newResultStore(config Config) (ResultStore, error) {
+	if config.ResultsDir == "" {
+		return &memoryResultStore{results: make(map[string]StoredResult)}, nil
+	}
+
+	if err := os.MkdirAll(config.ResultsDir, 0o755); err != nil {
+		return nil, err
+	}
+
+	return &fileResultStore{dir: config.ResultsDir}, nil
+}
+
+type memoryResultStore struct {
+	mu      sync.Mutex
+	results map[string]StoredResult
+}
+
+func (s *memoryResultStore) Put(id string, result StoredResult) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.results[id] = result
+	return nil
+}
+
+func (s *memoryResultStore) Get(id string) (StoredResult, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	result, ok := s.results[id]
+	if !ok || time.Now().After(result.Expires) {
+		return StoredResult{}, false, nil
+	}
+
+	return result, true, nil
+}
+
+func (s *memoryResultStore) Cleanup() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	for id, result := range s.results {
+		if now.After(result.Expires) {
+			delete(s.results, id)
+		}
+	}
+
+	return nil
+}
+
+// One json file per result, survives restarts
+type fileResultStore struct {
+	dir string
+}
+
+func (s *fileResultStore) path(id string) string {
+	return filepath.Join(s.dir, id+".json")
+}
+
+func (s *fileResultStore) Put(id string, result StoredResult) error {
+	data, err := json.Marshal(result)
+	if err != nil {
+		return err
+	}
+
+	// Readers never see a half written file
+	tmp, err := ioutil.TempFile(s.dir, id+".*.tmp")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+
+	return os.Rename(tmp.Name(), s.path(id))
+}
+
+func (s *fileResultStore) read(path string) (StoredResult, error) {
+	var result StoredResult
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return result, err
+	}
+
+	err = json.Unmarshal(data, &result)
+	return result, err
+}
+
+func (s *fileResultStore) Get(id string) (StoredResult, bool, error) {
+	result, err := s.read(s.path(id))
+	if os.IsNotExist(err) {
+		return StoredResult{}, false, nil
+	}
+	if err != nil {
+		return StoredResult{}, false, err
+	}
+
+	if time.Now().After(result.Expires) {
+		return StoredResult{}, false, nil
+	}
+
+	return result, true, nil
+}
+
+func (s *fileResultStore) Cleanup() error {
+	paths, err := filepath.Glob(filepath.Join(s.dir, "*.json"))
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	for _, path := range paths {
+		result, err := s.read(path)
+		if err != nil && !os.IsNotExist(err) {
+			log.Printf("Failed to read stored result \"%s\" : %s", path, err)
+			continue
+		}
+		if err == nil && now.After(result.Expires) {
+			os.Remove(path)
+		}
+	}
+
+	return nil
+}
+
+func cleanupResults(store ResultStore, interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := store.Cleanup(); err != nil {
+				log.Printf("Failed to clean up stored results: %s", err)
+			}
+		case <-stop:
+			return
+		}
+	}
+}
+
+// Copy of the response written through it, stored once the request completes
+type resultRecorder struct {
+	http.ResponseWriter
+	status int
+	body   []byte
+}
+
+func (r *resultRecorder) WriteHeader(status int) {
+	if r.status == 0 {
+		r.status = status
+	}
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *resultRecorder) Write(p []byte) (int, error) {
+	if r.status == 0 {
+		r.status = 200
+	}
+	r.body = append(r.body, p...)
+	return r.ResponseWriter.Write(p)
+}
+
+func (r *resultRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
+
+// Context of a stored request: client disconnect no longer cancels it, so the
+// result is there to retrieve, but its deadline is kept
+func detachedContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	detached := context.WithoutCancel(ctx)
+	if deadline, ok := ctx.Deadline(); ok {
+		return context.WithDeadline(detached, deadline)
+	}
+
+	return context.WithCancel(detached)
+}
+
+// Ids given by clients are unique only per tenant, so stored results are
+// keyed by both. Hash is safe in file names.
+func tenantScopedId(tenant, id string) string {
+	sum := sha256.Sum256([]byte(tenant + "\x00" + id))
+	return hex.EncodeToString(sum[:])
+}
+
+func (h *Handler) storeResult(id, tenant string, recorder *resultRecorder, urls []UrlEntry) {
+	if id == "" || recorder.status == 0 || !json.Valid(recorder.body) {
+		return
+	}
+
+	result := StoredResult{
+		Tenant:  tenant,
+		Status:  recorder.status,
+		Expires: time.Now().Add(h.config.ResultsTTL),
+		Body:    recorder.body,
+	}
+	for _, entry := range urls {
+		result.Urls = append(result.Urls, entry.Url)
+	}
+	if err := h.results.Put(tenantScopedId(tenant, id), result); err != nil {
+		log.Printf("Failed to store result of request \"%s\" : %s", id, err)
+	}
+}
+
+func (h *Handler) onResult(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != "GET" {
+		return errorResponse(w, 400, ErrorMethodNotAllowed, "Method not supported")
+	}
+
+	// Ids are checked before they reach file paths
+	id := strings.TrimPrefix(r.URL.Path, "/results/")
+	if !validRequestID.MatchString(id) {
+		return errorResponse(w, 404, ErrorNotFound, "Unknown request id")
+	}
+
+	result, ok, err := h.results.Get(tenantScopedId(h.tenantOf(r), id))
+	if err != nil {
+		return fmt.Errorf("failed to read stored result: %w", err)
+	}
+	if !ok || result.Tenant != h.tenantOf(r) {
+		return errorResponse(w, 404, ErrorNotFound, "Unknown or expired request id")
+	}
+
+	body := result.Body
+	query := r.URL.Query()
+	if query.Has("offset") || query.Has("limit") {
+		offset, limit, err := pageBounds(query.Get("offset"), query.Get("limit"))
+		if err != nil {
+			return errorResponse(w, 400, ErrorInvalidRequest, err.Error())
+		}
+
+		if body, err = pageResults(result, offset, limit); err != nil {
+			return fmt.Errorf("failed to page stored result: %w", err)
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(result.Status)
+	if _, err := w.Write(body); err != nil {
+		log.Printf("Failed to write response to client: %s", err)
+	}
+
+	return nil
+}
+
+func pageBounds(offsetValue, limitValue string) (int, int, error) {
+	offset, limit := 0, DefaultResultsPageSize
+	var err error
+	if offsetValue != "" {
+		if offset, err = strconv.Atoi(offsetValue); err != nil || offset < 0 {
+			return 0, 0, fmt.Errorf("offset must be a non-negative integer")
+		}
+	}
+
+	if limitValue != "" {
+		if limit, err = strconv.Atoi(limitValue); err != nil || limit < 1 || limit > MaxResultsPageSize {
+			return 0, 0, fmt.Errorf("limit must be between 1 and %d", MaxResultsPageSize)
+		}
+	}
+
+	return offset, limit, nil
+}
+
+// Stored response with a page of its results in the order of request urls,
+// batches return them in the order they complete. Total is the number of
+// all results. Responses without results are returned as is.
+func pageResults(stored StoredResult, offset, limit int) ([]byte, error) {
+	var response map[string]json.RawMessage
+	if err := json.Unmarshal(stored.Body, &response); err != nil {
+		return nil, err
+	}
+
+	var results []json.RawMessage
+	if data, ok := response["result"]; !ok || json.Unmarshal(data, &results) != nil {
+		return stored.Body, nil
+	}
+
+	// Positions of each url in the request, a url may be given several times
+	positions := make(map[string][]int)
+	for i, url := range stored.Urls {
+		positions[url] = append(positions[url], i)
+	}
+
+	order := make([]int, len(results))
+	for i, data := range results {
+		var result struct {
+			Url string `json:"url"`
+		}
+		_ = json.Unmarshal(data, &result)
+
+		// Results of unknown urls (e.g. projected without url) keep their place
+		order[i] = len(stored.Urls) + i
+		if free := positions[result.Url]; len(free) > 0 {
+			order[i] = free[0]
+			positions[result.Url] = free[1:]
+		}
+	}
+
+	sort.Stable(resultOrder{results, order})
+
+	page := []json.RawMessage{}
+	if offset < len(results) {
+		end := offset + limit
+		if end > len(results) {
+			end = len(results)
+		}
+		page = results[offset:end]
+	}
+
+	fields := make(map[string]interface{}, len(response)+3)
+	for name, value := range response {
+		fields[name] = value
+	}
+	fields["result"] = page
+	fields["total"] = len(results)
+	fields["offset"] = offset
+	fields["limit"] = limit
+
+	return json.Marshal(fields)
+}
+
+type resultOrder struct {
+	results []json.RawMessage
+	order   []int
+}
+
+func (o resultOrder) Len() int           { return len(o.results) }
+func (o resultOrder) Less(i, j int) bool { return o.order[i] < o.order[j] }
+func (o resultOrder) Swap(i, j int) {
+	o.results[i], o.results[j] = o.results[j], o.results[i]
+	o.order[i], o.order[j] = o.order[j], o.order[i]
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// Request schema versions. Requests without version are parsed leniently,
+// versioned ones are rejected on unknown fields.
+const (
+	RequestVersion1      = 1
+	LatestRequestVersion = RequestVersion1
+)
+
+var requestFields = jsonFieldNames(reflect.TypeOf(Request{}))
+
+type UnknownFieldsError struct {
+	Fields []string
+}
+
+func (e *UnknownFieldsError) Error() string {
+	return fmt.Sprintf("unknown fields: %s", strings.Join(e.Fields, ", "))
+}
+
+// Validates request json against the rules of its schema version
+func checkRequestSchema(data []byte, version int) error {
+	if version < RequestVersion1 || version > LatestRequestVersion {
+		return fmt.Errorf("unsupported version %d, latest is %d", version, LatestRequestVersion)
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	err := decoder.Decode(&Request{})
+	if err == nil {
+		return nil
+	}
+
+	// Decoder stops at the first unknown field, client wants to see all of them
+	var fields map[string]json.RawMessage
+	if json.Unmarshal(data, &fields) != nil {
+		return err
+	}
+
+	var unknown []string
+	for name := range fields {
+		if !requestFields[name] {
+			unknown = append(unknown, name)
+		}
+	}
+
+	if len(unknown) == 0 {
+		return err
+	}
+
+	sort.Strings(unknown)
+	return &UnknownFieldsError{Fields: unknown}
+}
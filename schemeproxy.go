@@ -0,0 +1,94 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	neturl "net/url"
+	"strings"
+)
+
+// Proxy of the transport chosen by url scheme: -http-proxy and -https-proxy,
+// -proxy (or environment) for a scheme without its own. Hosts of -no-proxy
+// are fetched directly whatever proxy would be chosen.
+type schemeProxy struct {
+	schemes     map[string]*neturl.URL
+	fallback    func(*http.Request) (*neturl.URL, error)
+	noProxy     []string
+	noProxyNets []*net.IPNet
+}
+
+func parseProxyUrl(value string) (*neturl.URL, error) {
+	proxyUrl, err := neturl.Parse(value)
+	if err != nil || !proxyUrl.IsAbs() {
+		return nil, fmt.Errorf("invalid proxy url \"%s\"", value)
+	}
+
+	return proxyUrl, nil
+}
+
+func newSchemeProxy(config Config, fallback func(*http.Request) (*neturl.URL, error)) (*schemeProxy, error) {
+	p := &schemeProxy{schemes: make(map[string]*neturl.URL), fallback: fallback}
+	for scheme, value := range map[string]string{"http": config.HTTPProxy, "https": config.HTTPSProxy} {
+		if value == "" {
+			continue
+		}
+
+		proxyUrl, err := parseProxyUrl(value)
+		if err != nil {
+			return nil, err
+		}
+		p.schemes[scheme] = proxyUrl
+	}
+
+	for _, item := range strings.Split(config.NoProxy, ",") {
+		item = strings.ToLower(strings.TrimSpace(item))
+		if item == "" {
+			continue
+		}
+
+		if _, ipNet, err := net.ParseCIDR(item); err == nil {
+			p.noProxyNets = append(p.noProxyNets, ipNet)
+			continue
+		}
+		p.noProxy = append(p.noProxy, strings.TrimPrefix(item, "."))
+	}
+
+	return p, nil
+}
+
+// Entries match the host itself and its subdomains, "*" matches all
+func (p *schemeProxy) bypass(host string) bool {
+	host = strings.ToLower(host)
+	if ip := net.ParseIP(host); ip != nil {
+		for _, ipNet := range p.noProxyNets {
+			if ipNet.Contains(ip) {
+				return true
+			}
+		}
+	}
+
+	for _, entry := range p.noProxy {
+		if entry == "*" || host == entry || strings.HasSuffix(host, "."+entry) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (p *schemeProxy) Proxy(r *http.Request) (*neturl.URL, error) {
+	if p.bypass(r.URL.Hostname()) {
+		return nil, nil
+	}
+
+	if proxyUrl, ok := p.schemes[r.URL.Scheme]; ok {
+		return proxyUrl, nil
+	}
+
+	if p.fallback == nil {
+		return nil, nil
+	}
+
+	return p.fallback(r)
+}
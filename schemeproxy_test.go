@@ -0,0 +1,62 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	neturl "net/url"
+	"testing"
+)
+
+func TestSchemeProxyChoice(t *testing.T) {
+	fallback, _ := neturl.Parse("http://fallback:3128")
+	tests := []struct {
+		name     string
+		config   Config
+		url      string
+		fallback bool
+		want     string
+	}{
+		{name: "http proxy for http", config: Config{HTTPProxy: "http://h:1", HTTPSProxy: "http://s:2"}, url: "http://example.com/", want: "http://h:1"},
+		{name: "https proxy for https", config: Config{HTTPProxy: "http://h:1", HTTPSProxy: "http://s:2"}, url: "https://example.com/", want: "http://s:2"},
+		{name: "direct for scheme without proxy", config: Config{HTTPSProxy: "http://s:2"}, url: "http://example.com/", want: ""},
+		{name: "fallback for scheme without proxy", config: Config{HTTPSProxy: "http://s:2"}, url: "http://example.com/", fallback: true, want: "http://fallback:3128"},
+		{name: "no-proxy host", config: Config{HTTPProxy: "http://h:1", NoProxy: "example.com"}, url: "http://example.com/", want: ""},
+		{name: "no-proxy subdomain", config: Config{HTTPProxy: "http://h:1", NoProxy: ".example.com"}, url: "http://api.EXAMPLE.com/", want: ""},
+		{name: "no-proxy is no suffix match", config: Config{HTTPProxy: "http://h:1", NoProxy: "example.com"}, url: "http://notexample.com/", want: "http://h:1"},
+		{name: "no-proxy cidr", config: Config{HTTPSProxy: "http://s:2", NoProxy: "10.0.0.0/8"}, url: "https://10.1.2.3/", want: ""},
+		{name: "outside no-proxy cidr", config: Config{HTTPSProxy: "http://s:2", NoProxy: "10.0.0.0/8"}, url: "https://11.1.2.3/", want: "http://s:2"},
+		{name: "no-proxy wildcard skips fallback", config: Config{NoProxy: "*"}, url: "http://example.com/", fallback: true, want: ""},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var fallbackProxy func(*http.Request) (*neturl.URL, error)
+			if test.fallback {
+				fallbackProxy = http.ProxyURL(fallback)
+			}
+
+			proxy, err := newSchemeProxy(test.config, fallbackProxy)
+			if err != nil {
+				t.Fatalf("newSchemeProxy: %v", err)
+			}
+
+			got, err := proxy.Proxy(httptest.NewRequest("GET", test.url, nil))
+			if err != nil {
+				t.Fatalf("Proxy: %v", err)
+			}
+			gotUrl := ""
+			if got != nil {
+				gotUrl = got.String()
+			}
+			if gotUrl != test.want {
+				t.Errorf("proxy of %s = %q, want %q", test.url, gotUrl, test.want)
+			}
+		})
+	}
+}
+
+func TestSchemeProxyInvalidUrl(t *testing.T) {
+	if _, err := newSchemeProxy(Config{HTTPSProxy: "not a url"}, nil); err == nil {
+		t.Errorf("newSchemeProxy accepted relative proxy url")
+	}
+}
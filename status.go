@@ -0,0 +1,190 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+func (c *ClientLimiter) Active() int32 {
+	return atomic.LoadInt32(&c.clientCount)
+}
+
+func (c *ClientLimiter) Limit() int32 {
+	return c.MaxConcurrentClients
+}
+
+func (h *Handler) isDraining() bool {
+	return atomic.LoadInt32(&h.draining) != 0
+}
+
+// Stops accepting new requests, in-flight ones are completed as usual. With
+// -api-keys set only clients with one of the keys may drain the server.
+func (h *Handler) onDrain(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != "POST" {
+		return errorResponse(w, 400, ErrorMethodNotAllowed, "Method not supported")
+	}
+
+	if len(h.apiKeys) > 0 && !h.apiKeys[r.Header.Get("X-API-Key")] {
+		return errorResponse(w, 401, ErrorUnauthorized, "Valid X-API-Key required")
+	}
+
+	atomic.StoreInt32(&h.draining, 1)
+	return jsonResponse(w, 200, map[string]interface{}{
+		"success": true,
+	})
+}
+
+// Result of the last canary fetch, shared by health probes for ttl
+type CanaryCheck struct {
+	url string
+	ttl time.Duration
+
+	mu      sync.Mutex
+	checked time.Time
+	err     error
+}
+
+func (c *CanaryCheck) fetch(ctx context.Context, client *http.Client) error {
+	request, err := http.NewRequestWithContext(ctx, "GET", c.url, nil)
+	if err != nil {
+		return err
+	}
+
+	resp, err := client.Do(request)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	// Read a bit of body so the connection can be reused
+	_, _ = io.Copy(ioutil.Discard, io.LimitReader(resp.Body, 4096))
+	if !(resp.StatusCode >= 200 && resp.StatusCode < 300) {
+		return fmt.Errorf("status code: %d", resp.StatusCode)
+	}
+
+	return nil
+}
+
+// Fetches canary url unless a recent result is cached
+func (c *CanaryCheck) Check(ctx context.Context, client *http.Client) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if time.Since(c.checked) < c.ttl {
+		return c.err
+	}
+
+	err := c.fetch(ctx, client)
+	if ctx.Err() != nil {
+		// Probe gone away, its result says nothing about egress
+		return err
+	}
+
+	c.err = err
+	c.checked = time.Now()
+	return err
+}
+
+// ?deep=1 additionally checks egress by fetching the canary url
+func (h *Handler) onHealthz(w http.ResponseWriter, r *http.Request) error {
+	if h.isDraining() {
+		return jsonResponse(w, 503, map[string]interface{}{
+			"status": "draining",
+		})
+	}
+
+	if r.URL.Query().Get("deep") == "1" && h.canary != nil {
+		if err := h.canary.Check(r.Context(), h.client); err != nil {
+			return jsonResponse(w, 503, map[string]interface{}{
+				"status": "unhealthy",
+				"reason": fmt.Sprintf("canary %s failed: %s", h.canary.url, err),
+			})
+		}
+	}
+
+	return jsonResponse(w, 200, map[string]interface{}{
+		"status": "ok",
+	})
+}
+
+// Liveness probe: the process serves requests. Never fails on load or drain,
+// restarting a busy instance only makes things worse.
+func (h *Handler) onLivez(w http.ResponseWriter, r *http.Request) error {
+	return jsonResponse(w, 200, map[string]interface{}{
+		"status": "ok",
+	})
+}
+
+// Readiness probe: new requests would be accepted. Not ready while draining
+// or when all client slots are taken, so traffic goes to other instances.
+func (h *Handler) onReadyz(w http.ResponseWriter, r *http.Request) error {
+	if h.isDraining() {
+		return jsonResponse(w, 503, map[string]interface{}{
+			"status": "draining",
+		})
+	}
+
+	if active, limit := h.limiter.Active(), h.limiter.Limit(); active >= limit {
+		return jsonResponse(w, 503, map[string]interface{}{
+			"status": "saturated",
+			"reason": fmt.Sprintf("%d of %d client slots taken", active, limit),
+		})
+	}
+
+	return jsonResponse(w, 200, map[string]interface{}{
+		"status": "ok",
+	})
+}
+
+func (h *Handler) onStats(w http.ResponseWriter, r *http.Request) error {
+	stats := map[string]interface{}{
+		"active_clients": h.limiter.Active(),
+		"max_clients":    h.limiter.Limit(),
+		"draining":       h.isDraining(),
+		"active_streams": atomic.LoadInt32(&h.streams),
+		"requests":       h.metrics.Snapshot(),
+		"slot_hold":      h.slotHold.Snapshot(),
+		// Remaining ms of hosts paused after 429
+		"host_cooldowns": h.cooldowns.Snapshot(),
+		// Active requests per tenant (API key hash or client IP)
+		"tenants": h.tenants.Snapshot(),
+	}
+	if h.cache != nil {
+		stats["cache"] = h.cache.Stats()
+	}
+	if h.hostSlots != nil {
+		// In-flight fetches per host across all requests
+		stats["host_in_flight"] = h.hostSlots.Snapshot()
+	}
+
+	return jsonResponse(w, 200, stats)
+}
+
+// Limits the server runs with, 0 means unlimited. max_urls is the limit of
+// the client asking, see -api-key-url-limits.
+func (h *Handler) onConfig(w http.ResponseWriter, r *http.Request) error {
+	return jsonResponse(w, 200, map[string]interface{}{
+		"max_connections":        h.config.MaxConnections,
+		"max_streams":            h.config.MaxStreams,
+		"limiter":                h.config.Limiter,
+		"max_clients":            MaxConcurrentClients,
+		"max_urls":               h.urlLimit(r),
+		"max_stream_urls":        h.config.MaxStreamUrls,
+		"max_body_bytes":         MaxBodyBytesPerUrl,
+		"max_retries":            MaxRetriesPerUrl,
+		"fetch_timeout_ms":       h.config.FetchTimeout.Milliseconds(),
+		"max_fetch_timeout_ms":   h.config.MaxFetchTimeout.Milliseconds(),
+		"request_ceiling_ms":     h.config.RequestCeiling.Milliseconds(),
+		"max_tasks_per_host":     h.config.MaxTasksPerHost,
+		"read_header_timeout_ms": h.config.ReadHeaderTimeout.Milliseconds(),
+		"read_timeout_ms":        h.config.ReadTimeout.Milliseconds(),
+		"write_timeout_ms":       h.config.WriteTimeout.Milliseconds(),
+		"idle_timeout_ms":        h.config.IdleTimeout.Milliseconds(),
+	})
+}
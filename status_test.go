@@ -0,0 +1,41 @@
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestDrainRequiresApiKey(t *testing.T) {
+	tests := []struct {
+		name         string
+		apiKeys      map[string]bool
+		key          string
+		wantStatus   int
+		wantDraining bool
+	}{
+		{name: "no keys configured", wantStatus: 200, wantDraining: true},
+		{name: "configured key", apiKeys: map[string]bool{"secret": true}, key: "secret", wantStatus: 200, wantDraining: true},
+		{name: "no key", apiKeys: map[string]bool{"secret": true}, wantStatus: 401},
+		{name: "unknown key", apiKeys: map[string]bool{"secret": true}, key: "guess", wantStatus: 401},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			h := &Handler{apiKeys: test.apiKeys}
+			r := httptest.NewRequest("POST", "/drain", nil)
+			if test.key != "" {
+				r.Header.Set("X-API-Key", test.key)
+			}
+
+			w := httptest.NewRecorder()
+			handleErrors(h.onDrain).ServeHTTP(w, r)
+
+			if w.Code != test.wantStatus {
+				t.Errorf("status = %d, want %d", w.Code, test.wantStatus)
+			}
+			if h.isDraining() != test.wantDraining {
+				t.Errorf("draining = %t, want %t", h.isDraining(), test.wantDraining)
+			}
+		})
+	}
+}
@@ -0,0 +1,446 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	NdjsonContentType = "application/x-ndjson"
+	ZipContentType    = "application/zip"
+	CsvContentType    = "text/csv"
+)
+
+// Formats of streaming response, selected by ?stream=
+const (
+	// One result per line, the last line reports the overall status
+	StreamNdjson = "ndjson"
+	// Valid JSON array of results, an error object is the last element
+	// when the stream ended early
+	StreamArray = "array"
+	// ZIP archive of bodies with a manifest, selected by Accept: application/zip
+	StreamZip = "zip"
+	// Row of url, status, body size and hash per result, selected by
+	// Accept: text/csv
+	StreamCsv = "csv"
+)
+
+func isNdjsonRequest(r *http.Request) bool {
+	mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	return err == nil && mediaType == NdjsonContentType
+}
+
+func accepts(r *http.Request, contentType string) bool {
+	for _, value := range strings.Split(r.Header.Get("Accept"), ",") {
+		if mediaType, _, err := mime.ParseMediaType(value); err == nil && mediaType == contentType {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Returns streaming response format, empty for a batch response
+func streamFormat(r *http.Request) (string, error) {
+	switch format := r.URL.Query().Get("stream"); format {
+	case StreamNdjson, StreamArray:
+		return format, nil
+	case "":
+		if accepts(r, ZipContentType) {
+			return StreamZip, nil
+		}
+		if accepts(r, CsvContentType) {
+			return StreamCsv, nil
+		}
+		if isNdjsonRequest(r) {
+			return StreamNdjson, nil
+		}
+		return "", nil
+	default:
+		return "", fmt.Errorf("unknown stream format \"%s\"", format)
+	}
+}
+
+var errTooManyStreamUrls = errors.New("number of urls exceeds the maximum")
+
+// Reads one url entry (JSON string or object) per line and feeds it to tasks
+func readStreamUrls(ctx context.Context, r io.Reader, maxUrls int, tasks chan<- UrlEntry) error {
+	scanner := bufio.NewScanner(r)
+	count := 0
+	for scanner.Scan() {
+		line := scanner.Bytes()
+		if len(line) == 0 {
+			continue
+		}
+
+		var entry UrlEntry
+		if err := json.Unmarshal(line, &entry); err != nil {
+			return fmt.Errorf("invalid url at line %d: %s", count+1, err)
+		}
+
+		count++
+		if count > maxUrls {
+			return fmt.Errorf("%w (%d)", errTooManyStreamUrls, maxUrls)
+		}
+
+		select {
+		case tasks <- entry:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+
+	return scanner.Err()
+}
+
+// Urls of long lists are uploaded while results stream back, so a NDJSON
+// body may take as long as the stream. Each read moves the deadline of
+// -read-timeout on, a client sending nothing for that long is still cut.
+type slidingDeadlineReader struct {
+	r       io.Reader
+	rc      *http.ResponseController
+	timeout time.Duration
+}
+
+func (h *Handler) slidingReadDeadline(w http.ResponseWriter, body io.Reader) io.Reader {
+	if h.config.ReadTimeout <= 0 {
+		return body
+	}
+
+	return &slidingDeadlineReader{r: body, rc: http.NewResponseController(w), timeout: h.config.ReadTimeout}
+}
+
+func (s *slidingDeadlineReader) Read(p []byte) (int, error) {
+	// Not every connection supports deadlines, the server one is kept then
+	_ = s.rc.SetReadDeadline(time.Now().Add(s.timeout))
+	return s.r.Read(p)
+}
+
+func feedUrls(urls []UrlEntry) func(context.Context, chan<- UrlEntry) error {
+	return func(ctx context.Context, tasks chan<- UrlEntry) error {
+		for _, entry := range byPriority(urls) {
+			select {
+			case tasks <- entry:
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+
+		return nil
+	}
+}
+
+// Final status of a stream, err is the reason it ended early. terminatedEarly
+// reports remaining urls were cancelled after max_results were collected.
+func streamStatus(ctx context.Context, err error, terminatedEarly bool) map[string]interface{} {
+	if terminatedEarly {
+		return map[string]interface{}{
+			"success":          true,
+			"terminated_early": true,
+			"reason":           "max_results reached",
+		}
+	}
+
+	if err == nil {
+		return map[string]interface{}{"success": true}
+	}
+
+	code := ErrorInvalidRequest
+	if errors.Is(err, errTooManyStreamUrls) {
+		code = ErrorTooManyUrls
+	} else if canceledByToken(ctx) {
+		code = ErrorCanceled
+		err = errCanceledByToken
+	} else if errors.Is(err, context.DeadlineExceeded) {
+		code = ErrorTimeout
+	}
+
+	return map[string]interface{}{
+		"success":    false,
+		"error_code": code,
+		"reason":     err.Error(),
+	}
+}
+
+type streamWriter interface {
+	// Result is TaskResult, possibly projected
+	WriteResult(result interface{}) error
+	WriteProgress(event ProgressEvent) error
+	// Writes insignificant whitespace keeping idle connection alive
+	Heartbeat() error
+	// Completes the stream with streamStatus
+	Close(ctx context.Context, err error, terminatedEarly bool) error
+}
+
+type ndjsonStreamWriter struct {
+	w       io.Writer
+	encoder *json.Encoder
+}
+
+func (s *ndjsonStreamWriter) WriteResult(result interface{}) error {
+	return s.encoder.Encode(result)
+}
+
+func (s *ndjsonStreamWriter) WriteProgress(event ProgressEvent) error {
+	return s.encoder.Encode(event)
+}
+
+// Empty lines are skipped by NDJSON readers
+func (s *ndjsonStreamWriter) Heartbeat() error {
+	_, err := io.WriteString(s.w, "\n")
+	return err
+}
+
+func (s *ndjsonStreamWriter) Close(ctx context.Context, err error, terminatedEarly bool) error {
+	return s.encoder.Encode(streamStatus(ctx, err, terminatedEarly))
+}
+
+type arrayStreamWriter struct {
+	w       io.Writer
+	started bool
+}
+
+func (s *arrayStreamWriter) writeElement(data interface{}) error {
+	element, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+
+	separator := ","
+	if !s.started {
+		separator = "["
+		s.started = true
+	}
+
+	_, err = s.w.Write(append([]byte(separator), element...))
+	return err
+}
+
+func (s *arrayStreamWriter) WriteResult(result interface{}) error {
+	return s.writeElement(result)
+}
+
+func (s *arrayStreamWriter) WriteProgress(event ProgressEvent) error {
+	return s.writeElement(event)
+}
+
+// Whitespace is allowed between json tokens
+func (s *arrayStreamWriter) Heartbeat() error {
+	_, err := io.WriteString(s.w, " ")
+	return err
+}
+
+func (s *arrayStreamWriter) Close(ctx context.Context, err error, terminatedEarly bool) error {
+	if err != nil || terminatedEarly {
+		if err := s.writeElement(streamStatus(ctx, err, terminatedEarly)); err != nil {
+			return err
+		}
+	}
+
+	if !s.started {
+		_, err := io.WriteString(s.w, "[]\n")
+		return err
+	}
+
+	_, err = io.WriteString(s.w, "]\n")
+	return err
+}
+
+// Takes a slot of -max-streams, false if all are taken
+func (h *Handler) acquireStream() bool {
+	if h.config.MaxStreams == 0 {
+		atomic.AddInt32(&h.streams, 1)
+		return true
+	}
+
+	for {
+		current := atomic.LoadInt32(&h.streams)
+		if current >= int32(h.config.MaxStreams) {
+			return false
+		}
+
+		if atomic.CompareAndSwapInt32(&h.streams, current, current+1) {
+			return true
+		}
+	}
+}
+
+func (h *Handler) releaseStream() {
+	atomic.AddInt32(&h.streams, -1)
+}
+
+// Streaming mode: urls are taken from feed as they arrive and each result is
+// written as soon as it completes, so memory stays bounded regardless of the
+// number of urls. After maxResults successful results (0 - unlimited) the
+// remaining urls are cancelled.
+func (h *Handler) streamResults(w http.ResponseWriter, r *http.Request, format string, opts DownloadOptions, maxResults int, feed func(context.Context, chan<- UrlEntry) error) {
+	// Streams hold connections much longer than batches, so they have a limit
+	// of their own within the client limit
+	if !h.acquireStream() {
+		if err := h.rejectWithRetryAfter(w, "Max streaming responses reached"); err != nil {
+			log.Printf("Failed to write response to client: %s", err)
+		}
+		return
+	}
+	defer h.releaseStream()
+
+	rc := http.NewResponseController(w)
+	// HTTP/1.x server stops reading request body once the response has started
+	if err := rc.EnableFullDuplex(); err != nil {
+		log.Printf("Failed to enable full duplex: %s", err)
+	}
+
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+
+	retryBudget := int32(opts.RetryBudget)
+
+	tasks := make(chan UrlEntry)
+	feedErr := make(chan error, 1)
+	go func() {
+		defer close(tasks)
+		feedErr <- feed(ctx, tasks)
+	}()
+
+	results := make(chan TaskResult)
+	requestInfo(r).SetConcurrency(MaxConcurrentTasksPerRequest)
+	var wg sync.WaitGroup
+	for i := 0; i < MaxConcurrentTasksPerRequest; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for entry := range tasks {
+				select {
+				case results <- downloadWithRetries(ctx, h.clientFor(opts), entry, opts, &retryBudget):
+				case <-ctx.Done():
+					return
+				}
+			}
+		}()
+	}
+
+	go func() {
+		wg.Wait()
+		close(results)
+	}()
+
+	var out streamWriter
+	if format == StreamZip {
+		w.Header().Set("Content-Type", ZipContentType)
+		w.Header().Set("Content-Disposition", `attachment; filename="results.zip"`)
+		out = newZipStreamWriter(w)
+	} else if format == StreamCsv {
+		w.Header().Set("Content-Type", CsvContentType+"; charset=utf-8")
+		out = newCsvStreamWriter(w, !opts.StatusOnly)
+	} else if format == StreamArray {
+		w.Header().Set("Content-Type", "application/json")
+		out = &arrayStreamWriter{w: w}
+	} else {
+		w.Header().Set("Content-Type", NdjsonContentType)
+		out = &ndjsonStreamWriter{w: w, encoder: json.NewEncoder(w)}
+	}
+
+	// Fires only when nothing was written for the interval
+	var heartbeat <-chan time.Time
+	var ticker *time.Ticker
+	if h.config.HeartbeatInterval > 0 {
+		ticker = time.NewTicker(h.config.HeartbeatInterval)
+		defer ticker.Stop()
+		heartbeat = ticker.C
+	}
+
+	// nil channel never fires when progress is not reported
+	var progress <-chan ProgressEvent
+	if opts.Progress != nil {
+		progress = opts.Progress.Events()
+	}
+
+	completed, succeeded := 0, 0
+	terminatedEarly := false
+	defer func() { h.publishEvent(r, completed, succeeded) }()
+	for {
+		var result TaskResult
+		var ok bool
+		select {
+		case result, ok = <-results:
+		case <-heartbeat:
+			if err := out.Heartbeat(); err != nil {
+				log.Printf("Failed to write response to client: %s", err)
+				return
+			}
+
+			if err := rc.Flush(); err != nil {
+				log.Printf("Failed to flush response to client: %s", err)
+				return
+			}
+			continue
+		case event := <-progress:
+			if err := out.WriteProgress(event); err != nil {
+				log.Printf("Failed to write response to client: %s", err)
+				return
+			}
+
+			if err := rc.Flush(); err != nil {
+				log.Printf("Failed to flush response to client: %s", err)
+				return
+			}
+
+			if ticker != nil {
+				ticker.Reset(h.config.HeartbeatInterval)
+			}
+			continue
+		}
+		if !ok {
+			break
+		}
+
+		if err := out.WriteResult(projectResult(result, opts.Fields)); err != nil {
+			log.Printf("Failed to write response to client: %s", err)
+			return
+		}
+
+		if err := rc.Flush(); err != nil {
+			log.Printf("Failed to flush response to client: %s", err)
+			return
+		}
+
+		if ticker != nil {
+			ticker.Reset(h.config.HeartbeatInterval)
+		}
+
+		completed++
+		if result.Err == nil {
+			succeeded++
+		}
+		if maxResults > 0 && succeeded >= maxResults {
+			terminatedEarly = true
+			cancel()
+			break
+		}
+	}
+
+	var err error
+	if !terminatedEarly {
+		// Feed may still wait for request body after early termination
+		err = <-feedErr
+		if err == nil {
+			// All urls fed, but the request may have hit the deadline since
+			err = ctx.Err()
+		}
+	}
+
+	if err := out.Close(ctx, err, terminatedEarly); err != nil {
+		log.Printf("Failed to write response to client: %s", err)
+	}
+}
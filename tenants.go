@@ -0,0 +1,113 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Tenant granted a share this long ago still counts when shares are
+// computed, so slots freed by a busy tenant go to the one waiting
+const TenantShareWindow = 10 * time.Second
+
+// Keys of -api-keys and -api-key-url-limits
+func parseApiKeys(value string, urlLimits map[string]int) map[string]bool {
+	keys := make(map[string]bool, len(urlLimits))
+	for _, key := range strings.Split(value, ",") {
+		if key = strings.TrimSpace(key); key != "" {
+			keys[key] = true
+		}
+	}
+	for key := range urlLimits {
+		keys[key] = true
+	}
+
+	return keys
+}
+
+// Tenant of a request: its API key if the server knows it, client address
+// otherwise. Unknown keys don't count, or a client could take more shares by
+// sending random ones. Keys are hashed, tenant ids show up in stats.
+func (h *Handler) tenantOf(r *http.Request) string {
+	if key := r.Header.Get("X-API-Key"); h.apiKeys[key] {
+		sum := sha256.Sum256([]byte(key))
+		return "key:" + hex.EncodeToString(sum[:6])
+	}
+
+	return "ip:" + requestInfo(r).ClientIP
+}
+
+// Fair sharing of client slots between tenants. A tenant alone may take all
+// of them, but once others show up it gets no new slots above its equal share
+// until the others are served.
+type TenantShares struct {
+	mu     sync.Mutex
+	active map[string]int
+	// Last request of every tenant seen within TenantShareWindow
+	seen map[string]time.Time
+}
+
+func newTenantShares() *TenantShares {
+	return &TenantShares{
+		active: make(map[string]int),
+		seen:   make(map[string]time.Time),
+	}
+}
+
+func (t *TenantShares) Acquire(tenant string, maxClients int) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := time.Now()
+	tenants := 0
+	for id, last := range t.seen {
+		if now.Sub(last) > TenantShareWindow && t.active[id] == 0 {
+			delete(t.seen, id)
+			continue
+		}
+		tenants++
+	}
+	if _, ok := t.seen[tenant]; !ok {
+		tenants++
+	}
+
+	share := maxClients / tenants
+	if share < 1 {
+		share = 1
+	}
+
+	if t.active[tenant] >= share {
+		return false
+	}
+
+	// Rejected requests don't refresh it, a tenant is kept by being served
+	t.seen[tenant] = now
+	t.active[tenant]++
+	return true
+}
+
+func (t *TenantShares) Release(tenant string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.active[tenant]--
+	if t.active[tenant] <= 0 {
+		delete(t.active, tenant)
+	}
+}
+
+// Active requests per tenant
+func (t *TenantShares) Snapshot() map[string]int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	snapshot := make(map[string]int, len(t.active))
+	for tenant, active := range t.active {
+		snapshot[tenant] = active
+	}
+
+	return snapshot
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"net/http/httptrace"
+	"sync"
+	"time"
+)
+
+// Phases of a downstream fetch in ms. Phases of every redirect hop are
+// summed. A reused connection has no dns, connect and tls phases, they are 0.
+type Timing struct {
+	DNSMs     float64 `json:"dns_ms"`
+	ConnectMs float64 `json:"connect_ms"`
+	TLSMs     float64 `json:"tls_ms"`
+	// From sending the request to the first response byte of the last hop
+	FirstByteMs float64 `json:"first_byte_ms"`
+	TransferMs  float64 `json:"transfer_ms"`
+	// Connection of the last hop came from the idle pool
+	Reused bool `json:"reused_connection"`
+}
+
+// Collects Timing from httptrace hooks, some of them run on transport
+// goroutines
+type timingTrace struct {
+	mu       sync.Mutex
+	started  time.Time
+	dnsStart time.Time
+	// By address, dialer may try several addresses at once
+	connectStarts map[string]time.Time
+	tlsStart      time.Time
+	firstByte     time.Time
+	timing        Timing
+}
+
+func milliseconds(d time.Duration) float64 {
+	return float64(d.Microseconds()) / 1000
+}
+
+// Context tracing fetches made with it
+func (t *timingTrace) context(ctx context.Context) context.Context {
+	t.started = time.Now()
+	t.connectStarts = make(map[string]time.Time)
+	return httptrace.WithClientTrace(ctx, &httptrace.ClientTrace{
+		DNSStart: func(httptrace.DNSStartInfo) {
+			t.mu.Lock()
+			defer t.mu.Unlock()
+			t.dnsStart = time.Now()
+		},
+		DNSDone: func(httptrace.DNSDoneInfo) {
+			t.mu.Lock()
+			defer t.mu.Unlock()
+			t.timing.DNSMs += milliseconds(time.Since(t.dnsStart))
+		},
+		ConnectStart: func(network, addr string) {
+			t.mu.Lock()
+			defer t.mu.Unlock()
+			t.connectStarts[network+" "+addr] = time.Now()
+		},
+		// Failed attempts are left out, the connection used is measured
+		ConnectDone: func(network, addr string, err error) {
+			t.mu.Lock()
+			defer t.mu.Unlock()
+			if started, ok := t.connectStarts[network+" "+addr]; ok && err == nil {
+				t.timing.ConnectMs += milliseconds(time.Since(started))
+			}
+		},
+		TLSHandshakeStart: func() {
+			t.mu.Lock()
+			defer t.mu.Unlock()
+			t.tlsStart = time.Now()
+		},
+		TLSHandshakeDone: func(tls.ConnectionState, error) {
+			t.mu.Lock()
+			defer t.mu.Unlock()
+			t.timing.TLSMs += milliseconds(time.Since(t.tlsStart))
+		},
+		GotConn: func(info httptrace.GotConnInfo) {
+			t.mu.Lock()
+			defer t.mu.Unlock()
+			t.timing.Reused = info.Reused
+		},
+		GotFirstResponseByte: func() {
+			t.mu.Lock()
+			defer t.mu.Unlock()
+			t.firstByte = time.Now()
+		},
+	})
+}
+
+// Timing once the body is read
+func (t *timingTrace) done() *Timing {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	timing := t.timing
+	if !t.firstByte.IsZero() {
+		timing.FirstByteMs = milliseconds(t.firstByte.Sub(t.started))
+		timing.TransferMs = milliseconds(time.Since(t.firstByte))
+	}
+
+	return &timing
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"crypto/tls"
+	"time"
+)
+
+// Negotiated TLS parameters of a downstream connection
+type TLSInfo struct {
+	Version     string `json:"version"`
+	CipherSuite string `json:"cipher_suite"`
+	// Negotiated ALPN protocol, e.g. "h2"
+	Protocol string `json:"protocol,omitempty"`
+	// Leaf certificate of the peer
+	Subject  string     `json:"subject,omitempty"`
+	Issuer   string     `json:"issuer,omitempty"`
+	NotAfter *time.Time `json:"not_after,omitempty"`
+	// Certificate chain was verified against system roots
+	Verified bool `json:"verified"`
+}
+
+func newTLSInfo(state *tls.ConnectionState) *TLSInfo {
+	info := &TLSInfo{
+		Version:     tls.VersionName(state.Version),
+		CipherSuite: tls.CipherSuiteName(state.CipherSuite),
+		Protocol:    state.NegotiatedProtocol,
+		Verified:    len(state.VerifiedChains) > 0,
+	}
+	if len(state.PeerCertificates) > 0 {
+		cert := state.PeerCertificates[0]
+		info.Subject = cert.Subject.String()
+		info.Issuer = cert.Issuer.String()
+		info.NotAfter = &cert.NotAfter
+	}
+
+	return info
+}
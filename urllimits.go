@@ -0,0 +1,43 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Parses comma separated key=limit pairs of -api-key-url-limits
+func parseUrlLimits(value string) (map[string]int, error) {
+	limits := make(map[string]int)
+	for _, item := range strings.Split(value, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+
+		key, limitValue, ok := strings.Cut(item, "=")
+		if !ok || key == "" {
+			return nil, fmt.Errorf("url limit must be given as key=limit")
+		}
+
+		// Keys are secrets, errors don't repeat them
+		limit, err := strconv.Atoi(limitValue)
+		if err != nil || limit < 1 {
+			return nil, fmt.Errorf("url limit \"%s\" must be a positive integer", limitValue)
+		}
+		limits[key] = limit
+	}
+
+	return limits, nil
+}
+
+// Max urls of a batch request: limit of its X-API-Key if one is configured,
+// MaxUrlsPerRequest for other keys and anonymous requests
+func (h *Handler) urlLimit(r *http.Request) int {
+	if limit, ok := h.urlLimits[r.Header.Get("X-API-Key")]; ok {
+		return limit
+	}
+
+	return MaxUrlsPerRequest
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"strings"
+	"sync/atomic"
+)
+
+// User-Agents rotated across fetches, either round-robin or at random
+type UserAgentPool struct {
+	agents []string
+	random bool
+	next   uint32
+}
+
+// Agents come from comma separated list and file with one agent per line
+func newUserAgentPool(list, file, rotation string) (*UserAgentPool, error) {
+	pool := &UserAgentPool{}
+	switch rotation {
+	case "round-robin":
+	case "random":
+		pool.random = true
+	default:
+		return nil, fmt.Errorf("unknown rotation \"%s\"", rotation)
+	}
+
+	// Agents contain commas more often than not, file is one per line
+	for _, agent := range strings.Split(list, ",") {
+		if agent = strings.TrimSpace(agent); agent != "" {
+			pool.agents = append(pool.agents, agent)
+		}
+	}
+
+	if file != "" {
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, agent := range strings.Split(string(data), "\n") {
+			if agent = strings.TrimSpace(agent); agent != "" {
+				pool.agents = append(pool.agents, agent)
+			}
+		}
+	}
+
+	if len(pool.agents) == 0 {
+		return nil, fmt.Errorf("no user agents given")
+	}
+
+	return pool, nil
+}
+
+func (p *UserAgentPool) Next() string {
+	if p.random {
+		return p.agents[rand.Intn(len(p.agents))]
+	}
+
+	return p.agents[int(atomic.AddUint32(&p.next, 1)-1)%len(p.agents)]
+}
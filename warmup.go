@@ -0,0 +1,58 @@
+package main
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const PreconnectTimeout = 5 * time.Second
+
+// Opens connections to hosts with HEAD requests so first fetches skip the
+// handshakes. Failed hosts are only logged. Hosts without scheme are https.
+func preconnect(client *http.Client, hosts string) {
+	var wg sync.WaitGroup
+	for _, host := range strings.Split(hosts, ",") {
+		host = strings.TrimSpace(host)
+		if host == "" {
+			continue
+		}
+
+		url := host
+		if !strings.Contains(url, "://") {
+			url = "https://" + url
+		}
+
+		wg.Add(1)
+		go func(url string) {
+			defer wg.Done()
+
+			ctx, cancel := context.WithTimeout(context.Background(), PreconnectTimeout)
+			defer cancel()
+
+			started := time.Now()
+			request, err := http.NewRequestWithContext(ctx, "HEAD", url, nil)
+			if err != nil {
+				log.Printf("Failed to preconnect to \"%s\" : %s", url, err)
+				return
+			}
+
+			resp, err := client.Do(request)
+			if err != nil {
+				log.Printf("Failed to preconnect to \"%s\" : %s", url, err)
+				return
+			}
+			_, _ = io.Copy(ioutil.Discard, resp.Body)
+			resp.Body.Close()
+
+			// Any status will do, the connection is what matters
+			log.Printf("Preconnected to \"%s\" in %s (%s, status %d)", url, time.Since(started), resp.Proto, resp.StatusCode)
+		}(url)
+	}
+	wg.Wait()
+}
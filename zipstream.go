@@ -0,0 +1,162 @@
+package main
+
+import (
+	"archive/zip"
+	"context"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	neturl "net/url"
+	"path"
+	"strings"
+	"time"
+)
+
+// Archive entry listing urls and failures, written last
+const ZipManifestName = "manifest.json"
+
+// Writes every successful body as an archive entry as soon as it completes,
+// so bodies are never held together. Failed urls go to the manifest.
+type zipStreamWriter struct {
+	zw *zip.Writer
+	// Entry names taken so far, names of the same url path get a suffix
+	names  map[string]bool
+	files  []map[string]interface{}
+	failed []map[string]interface{}
+}
+
+func newZipStreamWriter(w io.Writer) *zipStreamWriter {
+	return &zipStreamWriter{
+		zw:     zip.NewWriter(w),
+		names:  map[string]bool{ZipManifestName: true},
+		files:  []map[string]interface{}{},
+		failed: []map[string]interface{}{},
+	}
+}
+
+// Longer entry names are cut, file systems limit name length
+const MaxZipEntryName = 128
+
+// Last element of url path, "index" for the root. Decoded path may hold
+// "..", separators or control characters, anything outside a safe set is
+// replaced so unzipping can't leave the target directory.
+func zipEntryName(url string) string {
+	name := ""
+	if parsed, err := neturl.Parse(url); err == nil {
+		name = path.Base(parsed.Path)
+	}
+	// Root, "." and ".."
+	if strings.Trim(name, "./") == "" {
+		return "index"
+	}
+
+	name = strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '.' || r == '-' || r == '_' {
+			return r
+		}
+		return '_'
+	}, name)
+	if len(name) > MaxZipEntryName {
+		name = name[:MaxZipEntryName]
+	}
+
+	return name
+}
+
+func (s *zipStreamWriter) uniqueName(name string) string {
+	ext := path.Ext(name)
+	base := strings.TrimSuffix(name, ext)
+	for i := 2; s.names[name]; i++ {
+		name = fmt.Sprintf("%s-%d%s", base, i, ext)
+	}
+	s.names[name] = true
+
+	return name
+}
+
+// Body as downloaded, undoing encoding for json transport
+func decodeBody(result TaskResult) ([]byte, error) {
+	switch result.Encoding {
+	case EncodingBase64:
+		return base64.StdEncoding.DecodeString(result.Result)
+	case EncodingHex:
+		return hex.DecodeString(result.Result)
+	}
+
+	return []byte(result.Result), nil
+}
+
+// Result is a TaskResult, fields are not allowed with zip
+func (s *zipStreamWriter) WriteResult(data interface{}) error {
+	result := data.(TaskResult)
+	if result.Err != nil {
+		s.failed = append(s.failed, map[string]interface{}{
+			"url":         result.Url,
+			"status_code": result.StatusCode,
+			"err":         result.Error,
+		})
+		return nil
+	}
+
+	body, err := decodeBody(result)
+	if err != nil {
+		return err
+	}
+
+	name := s.uniqueName(zipEntryName(result.Url))
+	entry, err := s.zw.CreateHeader(&zip.FileHeader{
+		Name:     name,
+		Method:   zip.Deflate,
+		Modified: time.Now(),
+	})
+	if err != nil {
+		return err
+	}
+	if _, err := entry.Write(body); err != nil {
+		return err
+	}
+
+	file := map[string]interface{}{
+		"url":         result.Url,
+		"name":        name,
+		"status_code": result.StatusCode,
+	}
+	if result.Truncated {
+		file["truncated"] = true
+	}
+	s.files = append(s.files, file)
+
+	// Entry is complete, send it instead of holding it in the deflater
+	return s.zw.Flush()
+}
+
+// Nothing can be inserted between archive entries
+func (s *zipStreamWriter) Heartbeat() error {
+	return nil
+}
+
+func (s *zipStreamWriter) WriteProgress(ProgressEvent) error {
+	return nil
+}
+
+func (s *zipStreamWriter) Close(ctx context.Context, err error, terminatedEarly bool) error {
+	manifest := streamStatus(ctx, err, terminatedEarly)
+	manifest["files"] = s.files
+	manifest["failed"] = s.failed
+
+	entry, err := s.zw.CreateHeader(&zip.FileHeader{
+		Name:     ZipManifestName,
+		Method:   zip.Deflate,
+		Modified: time.Now(),
+	})
+	if err != nil {
+		return err
+	}
+	if err := json.NewEncoder(entry).Encode(manifest); err != nil {
+		return err
+	}
+
+	return s.zw.Close()
+}